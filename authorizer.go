@@ -0,0 +1,20 @@
+package panda
+
+// Authorizer decides whether a client may subscribe to or publish over
+// a channel. It gets the client's ticket (empty if there is no
+// AuthenticationHandler) and rejects the action by returning an error,
+// whose text is sent to the client in an Error frame.
+type Authorizer func(client *Client, channel string, ticket string) error
+
+// runs the authorizer, if any, on the message and tells the client if it
+// rejects it.
+func (c *Client) authorize(authorizer Authorizer, message *Message) error {
+	if authorizer == nil {
+		return nil
+	}
+	err := authorizer(c, message.Channel, c.GetTicket())
+	if err != nil {
+		c.sendError(message, CodeUnauthorized, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package panda
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAuthorizers(t *testing.T) {
+	errForbidden := errors.New("forbidden")
+	deny := func(client *Client, channel string, ticket string) error {
+		if channel == "secret" {
+			return errForbidden
+		}
+		return nil
+	}
+	app := NewApp(Config{
+		SubscribeAuthorizer: deny,
+		PublishAuthorizer:   deny,
+	})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+
+	subscribe := func(channel string) {
+		t.Helper()
+		msg, err := newMessage(channel, "", Subscribe).marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscribe("secret")
+	if m := readTestMessage(t, conn); m.MsgType != Error || m.Code != CodeUnauthorized || m.Channel != "secret" || m.Message != errForbidden.Error() {
+		t.Fatalf("got %+v, want an Error frame of secret", m)
+	}
+	if got := client.Channels(); len(got) != 0 {
+		t.Errorf("got channels %v, want none", got)
+	}
+
+	if err := client.Publish("secret", "leak"); !errors.Is(err, errForbidden) {
+		t.Errorf("got error %v, want %v", err, errForbidden)
+	}
+	if m := readTestMessage(t, conn); m.MsgType != Error || m.Channel != "secret" {
+		t.Fatalf("got %+v, want an Error frame of secret", m)
+	}
+
+	subscribe("public")
+	waitFor(t, func() bool { return len(client.Channels()) == 1 })
+	if err := client.Publish("public", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if m := readTestMessage(t, conn); m.MsgType != Raw || m.Message != "hi" {
+		t.Fatalf("got %+v, want the published message", m)
+	}
+}
@@ -1,126 +1,253 @@
 package panda
 
 import (
-	"errors"
-	"syscall"
+	"sync"
 
-	"github.com/gorilla/websocket"
 	"github.com/techerfan/panda/logger"
 )
 
 type channel struct {
-	name      string
-	clients   []*Client
-	msgSender chan string
-	logger    logger.Logger
+	name string
+	// subscribers of the channel. It is guarded by lock.
+	clients map[*Client]struct{}
+	lock    *sync.RWMutex
+	// the sequence number of the last message. It is guarded by sendLock
+	// which also serializes the submissions of the messages to the fanout.
+	seq      uint64
+	sendLock *sync.Mutex
+	// closed when the channel is destroyed.
+	done        chan struct{}
+	destroyOnce *sync.Once
+	logger      logger.Logger
+	// the codec which messages are encoded with.
+	codec Codec
+	// the fanout which delivers messages to the subscribers.
+	fanout *fanout
+	// how the channel keeps its last messages.
+	history historyConfig
+	// the registry of the channel, which has the patterns that match it.
+	channels *channels
+	// the levels of the channel's name if it is a pattern (see isPattern).
+	// Patterns have subscribers but messages are not sent over them.
+	pattern []string
 }
 
 func NewChannel(logger logger.Logger, name string) *channel {
 	channel := &channel{
-		name:      name,
-		msgSender: make(chan string),
+		name:        name,
+		clients:     make(map[*Client]struct{}),
+		lock:        &sync.RWMutex{},
+		sendLock:    &sync.Mutex{},
+		done:        make(chan struct{}),
+		destroyOnce: &sync.Once{},
+		logger:      logger,
 	}
 
-	go channel.listener()
-
 	return channel
 }
 
-func (ch *channel) onNewMessage(message string) {
-	ch.sendMessageToClients(message)
-	// ch.sendMessageToSubscribers(message)
+func (ch *channel) addClient(cl *Client) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.clients[cl] = struct{}{}
 }
 
-func (ch *channel) addClient(cl *Client) {
-	ch.clients = append(ch.clients, cl)
+// adds the client and replays the messages of the history which it asks
+// for (see replayHistory) before any message which is sent after it. Only
+// the sequence number which the replay ends at is taken under sendLock; the
+// history is read after it, while the client's writer holds back the
+// messages which are sent in the meantime.
+func (ch *channel) subscribe(cl *Client, since uint64, last int) {
+	ch.sendLock.Lock()
+	ch.addClient(cl)
+	// patterns have no history of their own.
+	if ch.history.store == nil || ch.pattern != nil || (since == 0 && last <= 0) {
+		ch.sendLock.Unlock()
+		return
+	}
+	upTo := ch.seq
+	cl.beginReplay()
+	ch.sendLock.Unlock()
+
+	var frames []*frame
+	for _, message := range ch.replayHistory(since, upTo, last) {
+		msg, err := ch.codec.Encode(message)
+		if err != nil {
+			ch.logger.Error(err.Error())
+			continue
+		}
+		frames = append(frames, &frame{frameType: ch.codec.FrameType(), data: msg, message: message})
+	}
+	cl.enqueueReplay(frames)
 }
 
 func (ch *channel) removeClient(cl *Client) {
-	for i, el := range ch.clients {
-		if el == cl {
-			ch.clients = append(ch.clients[:i], ch.clients[i+1:]...)
-			return
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	delete(ch.clients, cl)
+}
+
+// returns a snapshot of the subscribers, so that fanouts do not hold
+// the lock while clients subscribe and unsubscribe.
+func (ch *channel) getClients() []*Client {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	clients := make([]*Client, 0, len(ch.clients))
+	for cl := range ch.clients {
+		clients = append(clients, cl)
+	}
+	return clients
+}
+
+// returns a snapshot of the subscribers of the channel and of the patterns
+// which match it. A client which is subscribed to several of them is
+// returned once, so that it gets each message once.
+func (ch *channel) getSubscribers() []*Client {
+	clients := ch.getClients()
+	if ch.channels == nil {
+		return clients
+	}
+	patterns := ch.channels.matchingPatterns(ch.name)
+	if len(patterns) == 0 {
+		return clients
+	}
+	seen := make(map[*Client]struct{}, len(clients))
+	for _, cl := range clients {
+		seen[cl] = struct{}{}
+	}
+	for _, pattern := range patterns {
+		for _, cl := range pattern.getClients() {
+			if _, ok := seen[cl]; !ok {
+				seen[cl] = struct{}{}
+				clients = append(clients, cl)
+			}
 		}
 	}
+	return clients
 }
 
 // sends message to clients which subscribed on the 'pande-client' side.
-func (ch *channel) sendMessageToClients(message string, checker ...func(*Client) bool) {
-	msg, err := (&messageStruct{
-		Message: message,
-		Channel: ch.name,
-		MsgType: Raw,
-	}).marshal()
+// Each message is stamped with the channel's next sequence number and is
+// submitted to the fanout in that order, so that every subscriber gets the
+// messages of a channel in the order they were sent (FIFO).
+func (ch *channel) sendMessageToClients(message *Message, checker ...func(*Client) bool) {
+	ch.sendLock.Lock()
+	defer ch.sendLock.Unlock()
+	if ch.isDestroyed() {
+		return
+	}
+	if ch.pattern != nil {
+		ch.logger.Error(ErrPatternPublish.Error() + ": " + ch.name)
+		return
+	}
+	ch.seq++
+	message.Channel = ch.name
+	message.Seq = ch.seq
+	msg, err := ch.codec.Encode(message)
 	if err != nil {
 		ch.logger.Error(err.Error())
+		return
 	}
-	for _, cl := range ch.clients {
-		go func(cl *Client) {
-			if len(checker) > 0 && !checker[0](cl) {
-				return
-			}
-			cl.lock.Lock()
-			defer cl.lock.Unlock()
-			err := cl.conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				// If connection is broken, there will be no need to
-				// keep the client anymore. So it's better to destroy
-				// the client when this error occured.
-				if errors.Is(err, syscall.EPIPE) {
-					// Because Destroy uses the same lock as this method
-					// does, therefore it should be called as a separate
-					// goroutine so this method can end and unlock the lock.
-					// Otherwise we will have a livelock.
-					go cl.Destroy()
-				}
-				cl.logger.Error(err.Error())
-			}
-		}(cl)
+	f, err := newPreparedFrame(ch.codec.FrameType(), msg, message)
+	if err != nil {
+		ch.logger.Error(err.Error())
+		return
+	}
+	if ch.history.store != nil {
+		ch.appendHistory(message)
 	}
+	ch.fanout.submit(ch.getSubscribers(), func(cl *Client) {
+		if len(checker) > 0 && !checker[0](cl) {
+			return
+		}
+		cl.enqueue(f)
+	})
 }
 
+// sends each client the message which the callback makes for it. Clients
+// which get the same message share one prepared frame. All of the messages
+// share one sequence number, as they are one message of the channel. As
+// they differ per client, they are not kept in the history.
 func (ch *channel) sendMessageToClientsByCallback(cb func(*Client) string, checker ...func(*Client) bool) {
-	for _, cl := range ch.clients {
-		go func(cl *Client) {
-			if len(checker) > 0 && !checker[0](cl) {
-				return
-			}
-			cl.lock.Lock()
-			defer cl.lock.Unlock()
-			msg, err := (&messageStruct{
-				Message: cb(cl),
+	ch.sendLock.Lock()
+	defer ch.sendLock.Unlock()
+	if ch.isDestroyed() {
+		return
+	}
+	if ch.pattern != nil {
+		ch.logger.Error(ErrPatternPublish.Error() + ": " + ch.name)
+		return
+	}
+	ch.seq++
+	seq := ch.seq
+	frames := make(map[string]*frame)
+	framesLock := &sync.Mutex{}
+	ch.fanout.submit(ch.getSubscribers(), func(cl *Client) {
+		if len(checker) > 0 && !checker[0](cl) {
+			return
+		}
+		message := cb(cl)
+		framesLock.Lock()
+		f, ok := frames[message]
+		if !ok {
+			m := &Message{
+				Message: message,
 				Channel: ch.name,
 				MsgType: Raw,
-			}).marshal()
-			if err != nil {
-				ch.logger.Error(err.Error())
+				Seq:     seq,
+			}
+			msg, err := ch.codec.Encode(m)
+			if err == nil {
+				f, err = newPreparedFrame(ch.codec.FrameType(), msg, m)
 			}
-			err = cl.conn.WriteMessage(websocket.TextMessage, msg)
 			if err != nil {
-				// If connection is broken, there will be no need to
-				// keep the client anymore. So it's better to destroy
-				// the client when this error occured.
-				if errors.Is(err, syscall.EPIPE) {
-					// Because Destroy uses the same lock as this method
-					// does, therefore it should be called as a separate
-					// goroutine so this method can end and unlock the lock.
-					// Otherwise we will have a livelock.
-					go cl.Destroy()
-				}
-				cl.logger.Error(err.Error())
+				framesLock.Unlock()
+				ch.logger.Error(err.Error())
+				return
 			}
-		}(cl)
+			frames[message] = f
+		}
+		framesLock.Unlock()
+		cl.enqueue(f)
+	})
+}
+
+// sends a presence frame (Joined or Left) to the subscribers. It is
+// ordered with the messages of the channel but it has no sequence number
+// and it is not kept in the history.
+func (ch *channel) sendPresence(message *Message) {
+	ch.sendLock.Lock()
+	defer ch.sendLock.Unlock()
+	if ch.isDestroyed() {
+		return
+	}
+	msg, err := ch.codec.Encode(message)
+	if err != nil {
+		ch.logger.Error(err.Error())
+		return
+	}
+	f, err := newPreparedFrame(ch.codec.FrameType(), msg, message)
+	if err != nil {
+		ch.logger.Error(err.Error())
+		return
 	}
+	ch.fanout.submit(ch.getClients(), func(cl *Client) {
+		cl.enqueue(f)
+	})
 }
 
+// stops the channel. Messages which are sent after that are dropped.
 func (ch *channel) destroy() {
-	ch = nil
+	ch.destroyOnce.Do(func() {
+		close(ch.done)
+	})
 }
 
-// it listens on 'msgSender' channel which is used in order to
-// handle channel's new messages.
-func (ch *channel) listener() {
-	for msg := range ch.msgSender {
-		ch.onNewMessage(msg)
+func (ch *channel) isDestroyed() bool {
+	select {
+	case <-ch.done:
+		return true
+	default:
+		return false
 	}
 }
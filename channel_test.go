@@ -0,0 +1,124 @@
+package panda
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// opens n compressed connections and returns their server sides.
+// The client sides discard whatever they receive.
+func newBenchConns(b *testing.B, n int) []*websocket.Conn {
+	b.Helper()
+	serverConns := make(chan *websocket.Conn)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrader.Upgrade(rw, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		serverConns <- conn
+	}))
+	b.Cleanup(server.Close)
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	conns := make([]*websocket.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		clientConn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { clientConn.Close() })
+		go func() {
+			for {
+				if _, _, err := clientConn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		conns = append(conns, <-serverConns)
+	}
+	return conns
+}
+
+// compares writing a broadcast to every subscriber one by one with
+// writing one prepared message, as sendMessageToClients does.
+func BenchmarkBroadcast(b *testing.B) {
+	const subscribers = 50
+	msg, err := JSONCodec{}.Encode(newMessage("orders", strings.Repeat(`{"id":42,"status":"shipped"},`, 150), Raw))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("per client", func(b *testing.B) {
+		conns := newBenchConns(b, subscribers)
+		b.SetBytes(int64(len(msg) * subscribers))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, conn := range conns {
+				if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("prepared", func(b *testing.B) {
+		conns := newBenchConns(b, subscribers)
+		b.SetBytes(int64(len(msg) * subscribers))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f, err := newPreparedFrame(websocket.TextMessage, msg, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, conn := range conns {
+				if err := conn.WritePreparedMessage(f.prepared); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestChannelOrder(t *testing.T) {
+	app := NewApp(Config{FanoutWorkers: 4, FanoutBatchSize: 1})
+	ch := app.channels.getChannelByName("editor")
+	var subscribers []*Client
+	for i := 0; i < 8; i++ {
+		cl := newQueueTestClient(Config{WriteQueueSize: 200})
+		ch.addClient(cl)
+		subscribers = append(subscribers, cl)
+	}
+	publisher := &Client{app: app}
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			app.Broadcast("editor", strconv.Itoa(i))
+		} else {
+			publisher.Publish("editor", strconv.Itoa(i))
+		}
+	}
+	app.fanouts.Wait()
+
+	for _, cl := range subscribers {
+		frames := queuedFrames(cl)
+		if len(frames) != 100 {
+			t.Fatalf("got %d messages, want 100", len(frames))
+		}
+		for i, data := range frames {
+			msg, err := unmarshalMsg([]byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Seq != uint64(i+1) || msg.Message != strconv.Itoa(i) {
+				t.Fatalf("got message %q with seq %d at %d", msg.Message, msg.Seq, i)
+			}
+		}
+	}
+}
@@ -2,46 +2,121 @@ package panda
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/techerfan/panda/logger"
 )
 
+// channels is the registry of an App's channels. Each App owns
+// its own registry so that apps in one process never share channels.
 type channels struct {
 	allChannels map[string]*channel
+	lock        *sync.Mutex
 	logger      logger.Logger
+	// the codec of the channels' messages.
+	codec Codec
+	// the fanout which delivers the channels' messages.
+	fanout *fanout
+	// how the channels keep their history.
+	history historyConfig
+	// whether names with wildcard levels are patterns (ChannelPatterns).
+	patternsEnabled bool
+	// the channels of allChannels which are patterns. It is guarded by
+	// lock, and index is rebuilt from it whenever it changes.
+	patterns map[string]*channel
+	index    atomic.Pointer[patternIndex]
 }
 
-var lock = &sync.Mutex{}
-var channelsInstance *channels
-
-func getChannelsInstance(logger logger.Logger) *channels {
-	if channelsInstance == nil {
-		lock.Lock()
-		defer lock.Unlock()
-		if channelsInstance == nil {
-			channelsInstance = &channels{
-				allChannels: make(map[string]*channel),
-				logger:      logger,
-			}
-		}
+func newChannels(logger logger.Logger, codec Codec, fanout *fanout, history historyConfig, patternsEnabled bool) *channels {
+	return &channels{
+		allChannels:     make(map[string]*channel),
+		patterns:        make(map[string]*channel),
+		lock:            &sync.Mutex{},
+		logger:          logger,
+		codec:           codec,
+		fanout:          fanout,
+		history:         history,
+		patternsEnabled: patternsEnabled,
 	}
-	return channelsInstance
+}
+
+// reports whether the channel name is a pattern of the registry.
+func (c *channels) isPattern(chName string) bool {
+	return c.patternsEnabled && isPattern(chName)
+}
+
+// returns the channel if it is in the registry. Unlike getChannelByName,
+// it does not create it.
+func (c *channels) lookupChannel(chName string) (*channel, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch, ok := c.allChannels[chName]
+	return ch, ok
 }
 
 func (c *channels) getChannelByName(chName string) *channel {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if ch, ok := c.allChannels[chName]; ok {
 		return ch
 	}
-	ch := c.addChannel(chName)
-	return ch
+	channel := NewChannel(c.logger, chName)
+	channel.codec = c.codec
+	channel.fanout = c.fanout
+	channel.history = c.history
+	channel.channels = c
+	if c.patternsEnabled {
+		channel.pattern = patternLevels(chName)
+	}
+	if channel.pattern != nil {
+		c.patterns[chName] = channel
+		c.index.Store(newPatternIndex(c.patterns))
+	} else if c.history.store != nil {
+		// the numbering goes on from the kept messages (e.g. after a restart).
+		seq, err := c.history.store.LastSeq(chName)
+		if err != nil {
+			c.logger.Error(err.Error())
+		}
+		channel.seq = seq
+	}
+	c.allChannels[chName] = channel
+	return channel
 }
 
-func (c *channels) addChannel(chName string) *channel {
-	if ch, ok := c.allChannels[chName]; !ok {
-		channel := NewChannel(c.logger, chName)
-		c.allChannels[chName] = channel
-		return channel
-	} else {
-		return ch
+// removes the channel from the registry and stops it.
+func (c *channels) removeChannel(chName string) {
+	c.lock.Lock()
+	ch, ok := c.allChannels[chName]
+	delete(c.allChannels, chName)
+	if ok && ch.pattern != nil {
+		delete(c.patterns, chName)
+		c.index.Store(newPatternIndex(c.patterns))
+	}
+	c.lock.Unlock()
+	if ok {
+		ch.destroy()
+	}
+}
+
+// stops every channel of the registry.
+func (c *channels) destroy() {
+	c.lock.Lock()
+	all := c.allChannels
+	c.allChannels = make(map[string]*channel)
+	c.patterns = make(map[string]*channel)
+	c.index.Store(nil)
+	c.lock.Unlock()
+	for _, ch := range all {
+		ch.destroy()
+	}
+}
+
+// returns the patterns which match the channel name. It does not take
+// the lock, so that publishes over different channels do not contend.
+func (c *channels) matchingPatterns(chName string) []*channel {
+	index := c.index.Load()
+	if index == nil {
+		return nil
 	}
+	return index.match(chName)
 }
@@ -0,0 +1,25 @@
+package panda
+
+import "testing"
+
+func TestChannelsArePerApp(t *testing.T) {
+	first, second := NewApp(), NewApp()
+
+	ch := first.channels.getChannelByName("room")
+	if ch != first.channels.getChannelByName("room") {
+		t.Error("expected the same channel for the same name")
+	}
+	if ch == second.channels.getChannelByName("room") {
+		t.Error("expected apps not to share channels")
+	}
+
+	first.Destroy("room")
+	select {
+	case <-ch.done:
+	default:
+		t.Error("expected the destroyed channel to be stopped")
+	}
+	if ch == first.channels.getChannelByName("room") {
+		t.Error("expected a new channel after the old one was destroyed")
+	}
+}
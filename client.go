@@ -6,9 +6,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,19 +19,76 @@ import (
 var idCounter = uint32(makeRandomInt(3))
 
 type Client struct {
-	ctx                context.Context
-	cancelCtx          context.CancelFunc
-	app                *App
-	conn               *websocket.Conn
-	lock               *sync.Mutex
-	id                 string
-	stopListening      chan bool
-	isListening        bool
-	newMessage         chan string
-	subscribedChannels []*channel
-	listeners          map[string]chan string
-	ticket             string
-	logger             logger.Logger
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+	app       *App
+	// the current connection. It is guarded by lock.
+	conn *websocket.Conn
+	lock *sync.Mutex
+	id   string
+	// set by Destroy. It is guarded by lock.
+	isDestroyed      bool
+	stopListening    chan bool
+	isListening      bool
+	newMessage       chan string
+	isListeningBytes bool
+	newBytes         chan []byte
+	listeners        map[string]chan string
+	bytesListeners   map[string]chan []byte
+	// guards isListening, isListeningBytes, listeners and bytesListeners.
+	listenersLock *sync.RWMutex
+	// channels which the client is subscribed to by their names.
+	subscribedChannels map[string]*channel
+	channelsLock       *sync.Mutex
+	// frames which wait for the writer.
+	outbound chan *frame
+	// frames of the channels' history which wait for the writer. They
+	// are written before the queued frames and, unlike them, they are
+	// never dropped. replayReady wakes the writer up for them. While
+	// replays are being read, the writer holds back the queued frames (and
+	// keeps a frame which it dequeued in held). All of them are guarded by
+	// replayLock.
+	replayed    []*frame
+	held        []*frame
+	replaying   int
+	replayLock  *sync.Mutex
+	replayReady chan struct{}
+	// Raw frames which wait for the router.
+	events chan *Message
+	// channels of the calls (by Call) which wait for the client's
+	// replies by the IDs of the calls. It is guarded by callsLock.
+	calls     map[string]chan *Message
+	callsLock *sync.Mutex
+	// set once the client is being closed for being too slow.
+	isDisconnecting uint32
+	// the ticket of the current connection. It is guarded by lock.
+	ticket string
+	// destroys the client once its ticket expires. It is guarded by lock.
+	expiryTimer *time.Timer
+	logger      logger.Logger
+	// metadata which is shown to the others by presence (e.g. a user
+	// name). It is guarded by lock.
+	metadata map[string]string
+	// the token which resumes the client's session. It is empty if
+	// sessions are disabled.
+	session string
+	// closed when the current connection is lost. It is guarded by lock.
+	connDone chan struct{}
+	// closed when the writer of the current connection returns, so that
+	// the writer of the next one starts after it. It is guarded by lock.
+	writerDone chan struct{}
+	// a frame which the writer dequeued but could not write, so that the
+	// writer of the next connection writes it first. Only writers use it,
+	// one at a time.
+	pending *frame
+	// set while the connection is lost and the session waits to be
+	// resumed, which destroys the client once it fires. They are guarded
+	// by lock.
+	isDetached bool
+	graceTimer *time.Timer
+	// set if the current connection resumed the session. It is guarded
+	// by lock.
+	isResumed bool
 }
 
 func newClient(
@@ -41,108 +99,281 @@ func newClient(
 ) *Client {
 	ctx, cancel := context.WithCancel(context.Background())
 	client := &Client{
-		ctx:           ctx,
-		cancelCtx:     cancel,
-		app:           app,
-		conn:          conn,
-		lock:          &sync.Mutex{},
-		id:            makeId(),
-		stopListening: make(chan bool),
-		newMessage:    make(chan string),
-		listeners:     make(map[string]chan string),
-		ticket:        ticket,
-		logger:        logger,
-	}
-
-	go client.reader()
-
-	closeHandlerInstance := conn.CloseHandler()
-	conn.SetCloseHandler(func(code int, text string) error {
-		// recovering from closing a closed channel
-		defer func() {
-			if r := recover(); r != nil {
-				logger.Error("an error occured while closing the connections", r)
-			}
-		}()
-		client.closeHandler()
-		client.cancelCtx()
-		client = nil
-		close(client.stopListening)
-		return closeHandlerInstance(code, text)
-	})
+		ctx:                ctx,
+		cancelCtx:          cancel,
+		app:                app,
+		conn:               conn,
+		lock:               &sync.Mutex{},
+		id:                 makeId(),
+		stopListening:      make(chan bool),
+		newMessage:         make(chan string),
+		newBytes:           make(chan []byte),
+		listeners:          make(map[string]chan string),
+		bytesListeners:     make(map[string]chan []byte),
+		listenersLock:      &sync.RWMutex{},
+		subscribedChannels: make(map[string]*channel),
+		channelsLock:       &sync.Mutex{},
+		outbound:           make(chan *frame, app.config.WriteQueueSize),
+		replayLock:         &sync.Mutex{},
+		replayReady:        make(chan struct{}, 1),
+		events:             make(chan *Message, app.config.EventQueueSize),
+		calls:              make(map[string]chan *Message),
+		callsLock:          &sync.Mutex{},
+		ticket:             ticket,
+		logger:             logger,
+		connDone:           make(chan struct{}),
+	}
+	if app.config.SessionGracePeriod > 0 {
+		client.session = makeSessionToken()
+	}
 
 	return client
 }
 
+// starts the client's goroutines. The client must be registered on
+// the app before, so that it is never torn down before it is tracked.
+// Close frames are answered by the default close handler and the
+// reader destroys the client once it gets one.
+func (c *Client) start() {
+	go c.router()
+	c.lock.Lock()
+	conn, connDone := c.conn, c.connDone
+	c.lock.Unlock()
+	c.run(conn, connDone)
+}
+
+// starts the goroutines of a connection: its reader, its writer and its
+// heartbeat. They return once the connection is lost.
+func (c *Client) run(conn *websocket.Conn, connDone chan struct{}) {
+	c.extendReadDeadline(conn)
+	conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline(conn)
+		return nil
+	})
+
+	c.lock.Lock()
+	previousWriter := c.writerDone
+	writerDone := make(chan struct{})
+	c.writerDone = writerDone
+	c.lock.Unlock()
+
+	var hello *frame
+	if c.session != "" {
+		hello = c.sessionFrame()
+	}
+	go c.reader(conn)
+	go c.writer(conn, connDone, previousWriter, writerDone, hello)
+	if c.app.config.PingInterval > 0 {
+		go c.heartbeat(conn, connDone)
+	}
+}
+
 func (c *Client) OnMessage(callback func(msg string)) {
-	c.isListening = true
+	c.setListening(&c.isListening, true)
 	go func() {
 		for {
 			select {
 			case msg := <-c.newMessage:
 				callback(msg)
 			case <-c.stopListening:
-				c.isListening = false
+				c.setListening(&c.isListening, false)
+				return
+			}
+		}
+	}()
+}
+
+// OnMessageBytes is like OnMessage but the callback receives binary
+// payloads (e.g. Data of the frames or binary frames of a text codec)
+// as they are. Text payloads are passed to it only if OnMessage is not
+// listening.
+func (c *Client) OnMessageBytes(callback func(data []byte)) {
+	c.setListening(&c.isListeningBytes, true)
+	go func() {
+		for {
+			select {
+			case data := <-c.newBytes:
+				callback(data)
+			case <-c.stopListening:
+				c.setListening(&c.isListeningBytes, false)
 				return
 			}
 		}
 	}()
 }
 
+func (c *Client) setListening(flag *bool, isListening bool) {
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+	*flag = isListening
+}
+
+// On listens to the Raw frames of the client on a channel. It blocks for
+// as long as the client lives and returns once it is destroyed;
+// App.Handle listens to all clients at once.
 func (c *Client) On(channelName string, callback func(msg string)) {
 	listenerChan := make(chan string)
 
+	c.listenersLock.Lock()
 	c.listeners[channelName] = listenerChan
+	c.listenersLock.Unlock()
 
-	for message := range listenerChan {
-		callback(message)
+	for {
+		select {
+		case message := <-listenerChan:
+			callback(message)
+		case <-c.stopListening:
+			c.listenersLock.Lock()
+			if c.listeners[channelName] == listenerChan {
+				delete(c.listeners, channelName)
+			}
+			c.listenersLock.Unlock()
+			return
+		}
+	}
+}
+
+// OnBytes is like On but the callback receives binary payloads as they
+// are. Text payloads are passed to it only if On is not listening on the
+// channel. It returns once the client is destroyed too.
+func (c *Client) OnBytes(channelName string, callback func(data []byte)) {
+	listenerChan := make(chan []byte)
+
+	c.listenersLock.Lock()
+	c.bytesListeners[channelName] = listenerChan
+	c.listenersLock.Unlock()
+
+	for {
+		select {
+		case data := <-listenerChan:
+			callback(data)
+		case <-c.stopListening:
+			c.listenersLock.Lock()
+			if c.bytesListeners[channelName] == listenerChan {
+				delete(c.bytesListeners, channelName)
+			}
+			c.listenersLock.Unlock()
+			return
+		}
 	}
 }
 
 func (c *Client) Send(message string) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	msg, err := newMessage("", message, Raw).marshal()
+	c.send(newMessage("", message, Raw))
+}
+
+// SendBytes is like Send but sends a binary payload.
+func (c *Client) SendBytes(data []byte) {
+	c.send(newBytesMessage("", data, Raw))
+}
+
+func (c *Client) send(message *Message) {
+	msg, err := c.app.config.Codec.Encode(message)
 	if err != nil {
 		c.logger.Error(err.Error())
 		return
 	}
-	err = c.conn.WriteMessage(websocket.TextMessage, msg)
-	if err != nil {
-		if errors.Is(err, syscall.EPIPE) {
-			// Because Destroy uses the same lock as this method
-			// does, therefore it should be called as a separate
-			// goroutine so this method can end and unlock the lock.
-			// Otherwise we will have a livelock.
-			go c.Destroy()
-		}
-		c.logger.Error(err.Error())
-	}
+	c.enqueue(&frame{frameType: c.app.config.Codec.FrameType(), data: msg, message: message})
 }
 
-func (c *Client) Publish(channel string, message string) {
-	go func() {
-		ch := getChannelsInstance(c.logger).getChannelByName(channel)
-		ch.msgSender <- message
-	}()
+// Publish sends the message over the channel. It returns the error of
+// PublishAuthorizer if the client may not publish over the channel, and
+// ErrPatternPublish if the channel is a pattern.
+func (c *Client) Publish(channel string, message string) error {
+	return c.publish(newMessage(channel, message, Raw))
+}
+
+// PublishBytes is like Publish but publishes a binary payload.
+func (c *Client) PublishBytes(channel string, data []byte) error {
+	return c.publish(newBytesMessage(channel, data, Raw))
+}
+
+// sends the message over the channel. It returns once the message has
+// its place in the channel's order, so that messages which are published
+// one after another reach the subscribers in the same order.
+func (c *Client) publish(message *Message) error {
+	if c.app.channels.isPattern(message.Channel) {
+		c.sendError(message, CodeInvalidChannel, ErrPatternPublish.Error())
+		return ErrPatternPublish
+	}
+	if err := c.authorize(c.app.config.PublishAuthorizer, message); err != nil {
+		return err
+	}
+	// subscribers get the payload only, not the ID of the client's frame.
+	c.app.channels.getChannelByName(message.Channel).sendMessageToClients(&Message{
+		MsgType: Raw,
+		Channel: message.Channel,
+		Message: message.Message,
+		Data:    message.Data,
+	})
+	return nil
 }
 
 func (c *Client) GetTicket() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.ticket
 }
 
+// destroys the client once its ticket expires at expiration. It replaces
+// the previous expiration (if any), so that a resumed session gets the
+// expiration of its new ticket. The client does not expire if it is nil.
+func (c *Client) setExpiration(expiration *time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+		c.expiryTimer = nil
+	}
+	if expiration == nil || c.isDestroyed {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(*expiration), func() {
+		c.lock.Lock()
+		isExpired := c.expiryTimer == timer && !c.isDestroyed
+		c.lock.Unlock()
+		if !isExpired {
+			return
+		}
+		c.app.removeClient(c)
+		if c.app.config.TicketTokenExpirationHandler != nil {
+			c.app.config.TicketTokenExpirationHandler(c)
+		}
+		if err := c.Destroy(); err != nil {
+			c.logger.Error(err.Error())
+		}
+	})
+	c.expiryTimer = timer
+}
+
 func (c *Client) Destroy() error {
 	defer func() {
-		if recover() != nil {
+		if recover() != nil && c.logger != nil {
 			c.logger.Error("an error occured while destroying a client")
 		}
 	}()
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	if c.isDestroyed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.isDestroyed = true
 	// because 'closeHandler' method sets client to nil, we
 	// should close the connection before we lose it.
-	err := c.conn.Close()
+	var err error
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+	}
+	if c.isDetached {
+		c.graceTimer.Stop()
+	} else {
+		err = c.conn.Close()
+	}
 	c.cancelCtx()
+	c.lock.Unlock()
+	// the client is unsubscribed without the lock, so that OnLeave
+	// callbacks may use it.
 	c.closeHandler()
 	close(c.stopListening)
 	return err
@@ -156,64 +387,259 @@ func (c *Client) Context() context.Context {
 	return c.ctx
 }
 
-func (c *Client) reader() {
+// reads the frames of a connection until it is lost.
+func (c *Client) reader(conn *websocket.Conn) {
+	limiter := newRateLimiter(c.app.config.RateLimit, c.app.config.RateLimitBurst)
 	for {
-		_, msg, err := c.conn.ReadMessage()
+		frameType, msg, err := conn.ReadMessage()
 		if err != nil {
-			c.logger.Error(err.Error())
-			c.Destroy()
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				atomic.AddUint64(&c.app.metrics.timedOutClients, 1)
+				c.logger.Warn("client " + c.id + " timed out")
+			} else {
+				c.logger.Error(err.Error())
+			}
+			// a client which says goodbye does not come back.
+			c.connectionLost(conn, websocket.IsCloseError(err, websocket.CloseNormalClosure))
 			return
 		}
+		c.extendReadDeadline(conn)
 
-		messageStruct, err := unmarshalMsg(msg)
-		if err != nil {
+		// frames are decoded even if they are over the limit, so that
+		// the Error frame can refer to them.
+		isAllowed := limiter.allow()
+		message, err := c.decode(frameType, msg)
+		switch {
+		case !isAllowed:
+			c.sendError(message, CodeRateLimited, "rate limit exceeded")
+		case err != nil:
 			c.logger.Error(err.Error())
-		}
-
-		if messageStruct != nil {
-			switch messageStruct.MsgType {
-			case Subscribe:
-				c.subscribeToChannel(messageStruct.Channel)
-			case Unsubscribe:
-				c.unsubscribeToChannel(messageStruct.Channel)
-			case Raw:
-				c.receiveRawMsg(messageStruct)
+			c.sendError(nil, CodeMalformedFrame, err.Error())
+		case message != nil:
+			if inbound := c.app.inboundHandler(); inbound != nil {
+				inbound(c, message)
+			} else {
+				c.dispatch(message)
 			}
 		}
 	}
 }
 
-func (c *Client) subscribeToChannel(channelName string) {
-	ch := getChannelsInstance(c.logger).getChannelByName(channelName)
-	ch.addClient(c)
-	c.subscribedChannels = append(c.subscribedChannels, ch)
+// decodes a frame which the client sent.
+func (c *Client) decode(frameType int, msg []byte) (*Message, error) {
+	if frameType == websocket.BinaryMessage && c.app.config.Codec.FrameType() == websocket.TextMessage {
+		// a text codec cannot decode binary frames, so that they
+		// are taken as raw binary payloads.
+		return newBytesMessage("", msg, Raw), nil
+	}
+	return c.app.config.Codec.Decode(msg)
 }
 
-func (c *Client) unsubscribeToChannel(channelName string) {
-	ch := getChannelsInstance(c.logger).getChannelByName(channelName)
-	ch.removeClient(c)
-	for i, channel := range c.subscribedChannels {
-		if ch == channel {
-			c.subscribedChannels = append(c.subscribedChannels[:i], c.subscribedChannels[i+1:]...)
+// handles a frame which the client sent regarding its msgType.
+func (c *Client) dispatch(message *Message) {
+	switch message.MsgType {
+	case Subscribe:
+		if c.authorize(c.app.config.SubscribeAuthorizer, message) == nil {
+			c.subscribeToChannel(message.Channel, message.Seq, message.Last)
+			c.ack(message)
+		}
+	case Unsubscribe:
+		c.unsubscribeToChannel(message.Channel)
+		c.ack(message)
+	case Publish:
+		if c.publish(message) == nil {
+			c.ack(message)
+		}
+	case Raw:
+		c.queueEvent(message)
+	case Request:
+		c.handleRequest(message)
+	case Response:
+		if !c.resolveCall(message) {
+			c.logger.Warn("client " + c.id + " answered an unknown request")
 		}
+	case Error:
+		// errors of clients are not answered, so that the two
+		// sides never bounce errors back and forth.
+		if !c.resolveCall(message) {
+			c.logger.Warn("client " + c.id + " sent an error: " + message.Message)
+		}
+	default:
+		c.sendError(message, CodeUnknownType, fmt.Sprintf("unknown msgType %d", message.MsgType))
 	}
 }
 
-func (c *Client) receiveRawMsg(msg *messageStruct) {
-	if msg.Channel != "" {
-		if ch, ok := c.listeners[msg.Channel]; ok {
-			ch <- msg.Message
-		}
-	} else {
-		if c.isListening {
-			c.newMessage <- msg.Message
+// confirms the message by an Ack frame if it has an ID.
+func (c *Client) ack(message *Message) {
+	if message.ID != "" {
+		c.send(newAckMessage(message.Channel, message.ID))
+	}
+}
+
+// sends the client an Error frame about the message (which may be nil
+// if it could not be decoded).
+func (c *Client) sendError(message *Message, code ErrorCode, text string) {
+	var channel, id string
+	if message != nil {
+		channel, id = message.Channel, message.ID
+	}
+	c.send(newErrorMessage(channel, id, code, text))
+}
+
+// moves the read deadline forward after each frame or pong, so that
+// a client which stays silent longer than ReadTimeout times out.
+func (c *Client) extendReadDeadline(conn *websocket.Conn) {
+	if c.app.config.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.app.config.ReadTimeout))
+	}
+}
+
+// pings the client every PingInterval until the connection is lost. A
+// client which misses its pongs is torn down by the reader when the read
+// deadline passes.
+func (c *Client) heartbeat(conn *websocket.Conn, connDone chan struct{}) {
+	ticker := time.NewTicker(c.app.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(c.app.config.PongTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.logger.Error(err.Error())
+				c.connectionLost(conn, false)
+				return
+			}
+		case <-connDone:
+			return
+		case <-c.ctx.Done():
+			return
 		}
 	}
 }
 
+// Join subscribes the client to a channel from the server side (e.g.
+// after matchmaking). The client is told by a Subscribe frame of the
+// channel unless it was already subscribed.
+func (c *Client) Join(channelName string) {
+	if c.subscribeToChannel(channelName, 0, 0) {
+		c.send(newMessage(channelName, "", Subscribe))
+	}
+}
+
+// Leave unsubscribes the client from a channel from the server side. The
+// client is told by an Unsubscribe frame of the channel unless it was not
+// subscribed.
+func (c *Client) Leave(channelName string) {
+	if c.unsubscribeToChannel(channelName) {
+		c.send(newMessage(channelName, "", Unsubscribe))
+	}
+}
+
+// Channels returns the names of the channels which the client is
+// subscribed to, in sorted order.
+func (c *Client) Channels() []string {
+	c.channelsLock.Lock()
+	defer c.channelsLock.Unlock()
+	names := make([]string, 0, len(c.subscribedChannels))
+	for name := range c.subscribedChannels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subscribes the client to the channel and replays the messages of the
+// channel's history after since and (or) the last ones. It returns false
+// if the client was already subscribed or it is destroyed.
+func (c *Client) subscribeToChannel(channelName string, since uint64, last int) bool {
+	ch := c.app.channels.getChannelByName(channelName)
+	ch.subscribe(c, since, last)
+	c.channelsLock.Lock()
+	previous, ok := c.subscribedChannels[channelName]
+	c.subscribedChannels[channelName] = ch
+	c.channelsLock.Unlock()
+	if ok && previous != ch {
+		// the previous channel of this name was destroyed.
+		previous.removeClient(c)
+	}
+	// the client may have been destroyed meanwhile, so that
+	// closeHandler has missed this channel.
+	if c.ctx.Err() != nil {
+		ch.removeClient(c)
+		return false
+	}
+	if ok && previous == ch {
+		return false
+	}
+	c.joined(ch)
+	return true
+}
+
+// unsubscribes the client from the channel. It returns false if the
+// client was not subscribed.
+func (c *Client) unsubscribeToChannel(channelName string) bool {
+	c.channelsLock.Lock()
+	ch, ok := c.subscribedChannels[channelName]
+	delete(c.subscribedChannels, channelName)
+	c.channelsLock.Unlock()
+	if ok {
+		ch.removeClient(c)
+		c.left(ch)
+	}
+	return ok
+}
+
+// passes the message to the listeners. Binary payloads go to the bytes
+// listeners and text payloads go to the string ones; if there is no
+// listener of the payload's kind, the payload is converted for the other.
+func (c *Client) receiveRawMsg(msg *Message) {
+	c.listenersLock.RLock()
+	ch, ok := c.listeners[msg.Channel]
+	bytesCh, bytesOk := c.bytesListeners[msg.Channel]
+	if msg.Channel == "" {
+		ch, ok = c.newMessage, c.isListening
+		bytesCh, bytesOk = c.newBytes, c.isListeningBytes
+	}
+	c.listenersLock.RUnlock()
+
+	switch {
+	case msg.isBinary() && bytesOk:
+		c.deliverBytes(bytesCh, msg.Data)
+	case msg.isBinary() && ok:
+		c.deliver(ch, string(msg.Data))
+	case ok:
+		c.deliver(ch, msg.Message)
+	case bytesOk:
+		c.deliverBytes(bytesCh, []byte(msg.Message))
+	}
+}
+
+// passes a message to a listener unless the client stops listening first.
+func (c *Client) deliver(listener chan string, msg string) {
+	select {
+	case listener <- msg:
+	case <-c.stopListening:
+	}
+}
+
+// passes a binary payload to a listener unless the client stops
+// listening first.
+func (c *Client) deliverBytes(listener chan []byte, data []byte) {
+	select {
+	case listener <- data:
+	case <-c.stopListening:
+	}
+}
+
 func (c *Client) closeHandler() {
-	for _, ch := range c.subscribedChannels {
+	c.channelsLock.Lock()
+	subscribedChannels := c.subscribedChannels
+	c.subscribedChannels = make(map[string]*channel)
+	c.channelsLock.Unlock()
+	for _, ch := range subscribedChannels {
 		ch.removeClient(c)
+		c.left(ch)
 	}
 	c.app.removeClient(c)
 	c = nil
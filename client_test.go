@@ -1,8 +1,11 @@
 package panda
 
 import (
+	"bytes"
+	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -21,3 +24,257 @@ func TestDestroy(t *testing.T) {
 		}
 	})
 }
+
+func TestOnReturns(t *testing.T) {
+	app := NewApp()
+	_, url := newTestServer(t, app)
+	_, client := dialTestClient(t, app, url)
+
+	returned := make(chan struct{}, 2)
+	go func() {
+		client.On("chat", func(msg string) {})
+		returned <- struct{}{}
+	}()
+	go func() {
+		client.OnBytes("chat", func(data []byte) {})
+		returned <- struct{}{}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client.Destroy()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Fatal("listener did not return once the client was destroyed")
+		}
+	}
+
+	client.listenersLock.RLock()
+	defer client.listenersLock.RUnlock()
+	if len(client.listeners) != 0 || len(client.bytesListeners) != 0 {
+		t.Errorf("got listeners %v and %v, want none", client.listeners, client.bytesListeners)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	app := NewApp(Config{CommunicationType: BINARY})
+	received := make(chan []byte, 1)
+	connected := make(chan *Client, 1)
+	app.NewConnection(func(client *Client) {
+		client.OnMessageBytes(func(data []byte) {
+			received <- data
+		})
+		connected <- client
+	})
+	_, url := newTestServer(t, app)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var client *Client
+	select {
+	case client = <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("client did not connect")
+	}
+
+	payload := []byte{0, 1, 2, 0xff}
+	frame, err := newBytesMessage("", payload, Raw).marshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, payload) {
+			t.Errorf("got %v, want %v", data, payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("payload was not received")
+	}
+
+	client.SendBytes(payload)
+	frameType, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != websocket.BinaryMessage {
+		t.Errorf("got frame type %d, want %d", frameType, websocket.BinaryMessage)
+	}
+	msg, err := unmarshalBinaryMsg(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Data, payload) {
+		t.Errorf("got %v, want %v", msg.Data, payload)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	app := NewApp(Config{
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  20 * time.Millisecond,
+	})
+	connected := make(chan *Client, 2)
+	app.NewConnection(func(client *Client) {
+		connected <- client
+	})
+	_, url := newTestServer(t, app)
+
+	// the gorilla client answers pings only while it is reading.
+	alive, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	aliveClient := <-connected
+
+	silent, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silentClient := <-connected
+
+	select {
+	case <-silentClient.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("silent client was not torn down")
+	}
+	if got := app.Metrics().TimedOutClients; got != 1 {
+		t.Errorf("got %d timed out clients, want 1", got)
+	}
+	if err := aliveClient.Context().Err(); err != nil {
+		t.Errorf("expected the client which answers pings to stay connected, got %v", err)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	app := NewApp()
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+
+	client.Join("room")
+	client.Join("room")
+	if m := readTestMessage(t, conn); m.MsgType != Subscribe || m.Channel != "room" {
+		t.Fatalf("got %+v, want a Subscribe frame of room", m)
+	}
+	if got := client.Channels(); !reflect.DeepEqual(got, []string{"room"}) {
+		t.Errorf("got channels %v", got)
+	}
+
+	// joining twice must not notify the client again.
+	app.Broadcast("room", "hi")
+	if m := readTestMessage(t, conn); m.MsgType != Raw || m.Message != "hi" {
+		t.Fatalf("got %+v, want the broadcast", m)
+	}
+
+	client.Leave("room")
+	client.Leave("room")
+	if m := readTestMessage(t, conn); m.MsgType != Unsubscribe || m.Channel != "room" {
+		t.Fatalf("got %+v, want an Unsubscribe frame of room", m)
+	}
+	if got := client.Channels(); len(got) != 0 {
+		t.Errorf("got channels %v, want none", got)
+	}
+
+	app.Broadcast("room", "bye")
+	client.Send("direct")
+	if m := readTestMessage(t, conn); m.Message != "direct" {
+		t.Fatalf("got %+v, want the direct message", m)
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	app := NewApp(Config{RateLimit: 1, RateLimitBurst: 3})
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+
+	write := func(frame string) {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(code ErrorCode, id string) {
+		t.Helper()
+		m := readTestMessage(t, conn)
+		if m.MsgType != Error || m.Code != code || m.ID != id {
+			t.Fatalf("got %+v, want an Error frame of %s for %q", m, code, id)
+		}
+	}
+
+	write("{not json")
+	expect(CodeMalformedFrame, "")
+	write(`{"msgType": 99, "id": "req-2"}`)
+	expect(CodeUnknownType, "req-2")
+	// errors of the client are not answered.
+	write(`{"msgType": 3, "id": "req-3"}`)
+	write(`{"msgType": 99, "id": "req-4"}`)
+	expect(CodeRateLimited, "req-4")
+}
+
+func TestAck(t *testing.T) {
+	app := NewApp()
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+
+	write := func(m *Message) {
+		t.Helper()
+		msg, err := m.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// frames without an ID are not acknowledged.
+	write(newMessage("news", "", Subscribe))
+	write(&Message{MsgType: Subscribe, Channel: "room", ID: "1"})
+	if m := readTestMessage(t, conn); m.MsgType != Ack || m.ID != "1" || m.Channel != "room" {
+		t.Fatalf("got %+v, want the Ack of 1", m)
+	}
+	if got := client.Channels(); !reflect.DeepEqual(got, []string{"news", "room"}) {
+		t.Errorf("got channels %v", got)
+	}
+
+	// the published message and the Ack may come in any order.
+	write(&Message{MsgType: Publish, Channel: "room", Message: "hi", ID: "2"})
+	var published, acked bool
+	for i := 0; i < 2; i++ {
+		m := readTestMessage(t, conn)
+		switch {
+		case m.MsgType == Ack && m.ID == "2":
+			acked = true
+		case m.MsgType == Raw && m.Message == "hi" && m.ID == "" && m.Seq == 1:
+			published = true
+		default:
+			t.Fatalf("unexpected frame %+v", m)
+		}
+	}
+	if !published || !acked {
+		t.Errorf("published: %v, acked: %v", published, acked)
+	}
+
+	write(&Message{MsgType: Unsubscribe, Channel: "room", ID: "3"})
+	if m := readTestMessage(t, conn); m.MsgType != Ack || m.ID != "3" {
+		t.Fatalf("got %+v, want the Ack of 3", m)
+	}
+	if got := client.Channels(); !reflect.DeepEqual(got, []string{"news"}) {
+		t.Errorf("got channels %v", got)
+	}
+}
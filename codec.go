@@ -0,0 +1,197 @@
+package panda
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes messages into WebSocket frames and decodes frames
+// into messages.
+type Codec interface {
+	Encode(msg *Message) ([]byte, error)
+	Decode(data []byte) (*Message, error)
+	// FrameType is the WebSocket frame type which encoded messages are
+	// sent with (websocket.TextMessage or websocket.BinaryMessage).
+	FrameType() int
+}
+
+var codecsLock = &sync.RWMutex{}
+var codecs = map[CommunicationType]Codec{
+	JSON:    JSONCodec{},
+	BINARY:  BinaryCodec{},
+	XML:     XMLCodec{},
+	MSGPACK: MsgPackCodec{},
+	CBOR:    CBORCodec{},
+}
+
+// RegisterCodec makes a codec available by a communication type so that
+// it can be chosen by Config.CommunicationType. It replaces the codec which
+// is already registered for the type, including the built-in ones.
+func RegisterCodec(communicationType CommunicationType, codec Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[communicationType] = codec
+}
+
+func getCodec(communicationType CommunicationType) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecs[communicationType]
+	return codec, ok
+}
+
+// JSONCodec sends messages as JSON text frames.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(msg *Message) ([]byte, error) {
+	return msg.marshal()
+}
+
+func (JSONCodec) Decode(data []byte) (*Message, error) {
+	return unmarshalMsg(data)
+}
+
+func (JSONCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+// BinaryCodec sends messages as binary frames with a compact,
+// length-prefixed header. See message.go for the layout.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Encode(msg *Message) ([]byte, error) {
+	return msg.marshalBinary()
+}
+
+func (BinaryCodec) Decode(data []byte) (*Message, error) {
+	return unmarshalBinaryMsg(data)
+}
+
+func (BinaryCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+// XMLCodec sends messages as XML text frames whose root element is
+// <message>. Binary payloads are encoded in base64.
+type XMLCodec struct{}
+
+var xmlRoot = xml.StartElement{Name: xml.Name{Local: "message"}}
+
+// shadows Data of the message because XML cannot carry arbitrary bytes,
+// and Meta and Member because XML cannot carry maps.
+type xmlMessage struct {
+	*Message
+	Data   string         `xml:"data,omitempty"`
+	Meta   []xmlMetaEntry `xml:"meta>entry,omitempty"`
+	Member []xmlMetaEntry `xml:"member>entry,omitempty"`
+}
+
+type xmlMetaEntry struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (XMLCodec) Encode(msg *Message) ([]byte, error) {
+	xmlMsg := &xmlMessage{Message: msg}
+	if msg.isBinary() {
+		xmlMsg.Data = base64.StdEncoding.EncodeToString(msg.Data)
+	}
+	xmlMsg.Meta = xmlEntries(msg.Meta)
+	xmlMsg.Member = xmlEntries(msg.Member)
+	buf := &bytes.Buffer{}
+	if err := xml.NewEncoder(buf).EncodeElement(xmlMsg, xmlRoot); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (XMLCodec) Decode(data []byte) (*Message, error) {
+	xmlMsg := &xmlMessage{Message: &Message{}}
+	if err := xml.Unmarshal(data, xmlMsg); err != nil {
+		return nil, err
+	}
+	if xmlMsg.Data != "" {
+		decoded, err := base64.StdEncoding.DecodeString(xmlMsg.Data)
+		if err != nil {
+			return nil, err
+		}
+		xmlMsg.Message.Data = decoded
+	}
+	xmlMsg.Message.Meta = xmlMap(xmlMsg.Meta)
+	xmlMsg.Message.Member = xmlMap(xmlMsg.Member)
+	return xmlMsg.Message, nil
+}
+
+// returns the entries of a map sorted by their keys.
+func xmlEntries(m map[string]string) []xmlMetaEntry {
+	var entries []xmlMetaEntry
+	for key, value := range m {
+		entries = append(entries, xmlMetaEntry{Key: key, Value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// returns the map of the entries, or nil if there is none.
+func xmlMap(entries []xmlMetaEntry) map[string]string {
+	if len(entries) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		m[entry.Key] = entry.Value
+	}
+	return m
+}
+
+func (XMLCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+// MsgPackCodec sends messages as MessagePack binary frames.
+type MsgPackCodec struct{}
+
+func (MsgPackCodec) Encode(msg *Message) ([]byte, error) {
+	return msgpack.Marshal(msg)
+}
+
+func (MsgPackCodec) Decode(data []byte) (*Message, error) {
+	msg := &Message{}
+	if err := msgpack.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (MsgPackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+// CBORCodec sends messages as CBOR binary frames. Keys are the
+// same as the JSON ones.
+type CBORCodec struct{}
+
+func (CBORCodec) Encode(msg *Message) ([]byte, error) {
+	return cbor.Marshal(msg)
+}
+
+func (CBORCodec) Decode(data []byte) (*Message, error) {
+	msg := &Message{}
+	if err := cbor.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (CBORCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
@@ -0,0 +1,93 @@
+package panda
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Run("text payload", func(t *testing.T) {
+		testCodecs(t, &Message{
+			MsgType: Unsubscribe,
+			Channel: "orders.42",
+			Message: `<b>"quoted" & escaped</b>`,
+			Seq:     42,
+		})
+	})
+	t.Run("error", func(t *testing.T) {
+		testCodecs(t, newErrorMessage("chat", "req-1", CodeUnauthorized, "forbidden"))
+	})
+	t.Run("meta", func(t *testing.T) {
+		msg := newMessage("chat", "hi", Raw)
+		msg.Meta = map[string]string{"node": "eu-1", "ts": "1700000000"}
+		testCodecs(t, msg)
+	})
+	t.Run("joined", func(t *testing.T) {
+		testCodecs(t, &Message{
+			MsgType: Joined,
+			Channel: "chat",
+			ID:      "client-1",
+			Meta:    map[string]string{"node": "eu-1"},
+			Member:  map[string]string{"name": "alice", "role": "admin"},
+		})
+	})
+	t.Run("subscribe", func(t *testing.T) {
+		testCodecs(t, &Message{MsgType: Subscribe, Channel: "chat", Seq: 10, Last: 5})
+	})
+	t.Run("binary payload", func(t *testing.T) {
+		testCodecs(t, newBytesMessage("images", []byte{0, 1, 2, 0xff, '<'}, Raw))
+	})
+}
+
+func testCodecs(t *testing.T, msg *Message) {
+	for _, tc := range []struct {
+		communicationType CommunicationType
+		frameType         int
+	}{
+		{JSON, websocket.TextMessage},
+		{BINARY, websocket.BinaryMessage},
+		{XML, websocket.TextMessage},
+		{MSGPACK, websocket.BinaryMessage},
+		{CBOR, websocket.BinaryMessage},
+	} {
+		codec, ok := getCodec(tc.communicationType)
+		if !ok {
+			t.Fatalf("no codec is registered for %d", tc.communicationType)
+		}
+		if codec.FrameType() != tc.frameType {
+			t.Errorf("%T: got frame type %d, want %d", codec, codec.FrameType(), tc.frameType)
+		}
+		data, err := codec.Encode(msg)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("%T: got %+v, want %+v", codec, decoded, msg)
+		}
+	}
+}
+
+type upperCodec struct {
+	JSONCodec
+}
+
+func TestRegisterCodec(t *testing.T) {
+	const custom CommunicationType = 100
+	RegisterCodec(custom, upperCodec{})
+
+	app := NewApp(Config{CommunicationType: custom})
+	if _, ok := app.config.Codec.(upperCodec); !ok {
+		t.Errorf("got codec %T, want upperCodec", app.config.Codec)
+	}
+
+	app = NewApp(Config{CommunicationType: custom, Codec: XMLCodec{}})
+	if _, ok := app.config.Codec.(XMLCodec); !ok {
+		t.Errorf("got codec %T, want XMLCodec", app.config.Codec)
+	}
+}
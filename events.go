@@ -0,0 +1,70 @@
+package panda
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// EventHandler handles the Raw frames of clients whose channel is the
+// name of the event. The payload is the frame's Message (or Data).
+type EventHandler func(client *Client, channel string, payload string)
+
+// Handle registers the handler of an event for all clients. Clients send
+// an event by a Raw frame whose channel is its name; the name of messages
+// without a channel is "". Handlers of a client run one by one in the
+// order the frames were sent, but never on its reader, and a handler
+// which panics is recovered. The new handler replaces the previous one
+// (if any).
+func (a *App) Handle(event string, handler EventHandler) {
+	a.handlersLock.Lock()
+	defer a.handlersLock.Unlock()
+	a.eventHandlers[event] = handler
+}
+
+func (a *App) getEventHandler(event string) (EventHandler, bool) {
+	a.handlersLock.RLock()
+	defer a.handlersLock.RUnlock()
+	handler, ok := a.eventHandlers[event]
+	return handler, ok
+}
+
+// queues a Raw frame of the client for its router, so that the reader
+// never waits for handlers or listeners. The frame is dropped if the
+// queue is full.
+func (c *Client) queueEvent(message *Message) {
+	select {
+	case c.events <- message:
+	default:
+		atomic.AddUint64(&c.app.metrics.droppedEvents, 1)
+		c.logger.Warn("an event of client " + c.id + " was dropped as its queue is full")
+	}
+}
+
+// passes the queued frames of the client to the app's handler of their
+// event and to the client's listeners until the client is destroyed.
+func (c *Client) router() {
+	for {
+		select {
+		case message := <-c.events:
+			if handler, ok := c.app.getEventHandler(message.Channel); ok {
+				c.handleEvent(handler, message)
+			}
+			c.receiveRawMsg(message)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) handleEvent(handler EventHandler, message *Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Error(fmt.Sprintf("handler of event %q panicked: %v", message.Channel, r))
+		}
+	}()
+	payload := message.Message
+	if message.isBinary() {
+		payload = string(message.Data)
+	}
+	handler(c, message.Channel, payload)
+}
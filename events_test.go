@@ -0,0 +1,63 @@
+package panda
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandle(t *testing.T) {
+	app := NewApp()
+	type event struct {
+		client  *Client
+		channel string
+		payload string
+	}
+	handled := make(chan event, 10)
+	release := make(chan struct{})
+	app.Handle("chat", func(client *Client, channel string, payload string) {
+		handled <- event{client, channel, payload}
+	})
+	app.Handle("boom", func(client *Client, channel string, payload string) {
+		panic("boom")
+	})
+	app.Handle("slow", func(client *Client, channel string, payload string) {
+		<-release
+	})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+
+	writeTestMessage(t, conn, newMessage("boom", "", Raw))
+	writeTestMessage(t, conn, newMessage("chat", "first", Raw))
+	writeTestMessage(t, conn, newMessage("slow", "", Raw))
+	writeTestMessage(t, conn, newMessage("chat", "second", Raw))
+
+	select {
+	case e := <-handled:
+		if e.client != client || e.channel != "chat" || e.payload != "first" {
+			t.Errorf("got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event was not handled after a handler panicked")
+	}
+
+	// the reader goes on while a handler is busy.
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "room", ID: "1"})
+	if m := readTestMessage(t, conn); m.MsgType != Ack || m.ID != "1" {
+		t.Fatalf("got %+v, want the Ack of 1", m)
+	}
+	select {
+	case e := <-handled:
+		t.Fatalf("%+v was handled before the slow event", e)
+	default:
+	}
+
+	close(release)
+	select {
+	case e := <-handled:
+		if e.payload != "second" {
+			t.Errorf("got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event was not handled after the slow one")
+	}
+}
@@ -0,0 +1,136 @@
+package panda
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// fanout delivers messages to their recipients by a fixed number of
+// workers rather than by a goroutine per recipient. Recipients are sharded
+// by their IDs, so that a client is always served by the same worker and
+// gets messages in the order they were submitted.
+type fanout struct {
+	app       *App
+	workers   []chan *fanoutJob
+	batchSize int
+	// jobs which wait for a worker.
+	depth int64
+	// closed to stop the workers.
+	done     chan struct{}
+	stopOnce *sync.Once
+}
+
+// a batch of recipients which one worker serves.
+type fanoutJob struct {
+	clients []*Client
+	send    func(cl *Client)
+	// called once the batch is served.
+	finish func()
+}
+
+func newFanout(app *App, workers, batchSize, queueSize int) *fanout {
+	f := &fanout{
+		app:       app,
+		workers:   make([]chan *fanoutJob, workers),
+		batchSize: batchSize,
+		done:      make(chan struct{}),
+		stopOnce:  &sync.Once{},
+	}
+	for i := range f.workers {
+		f.workers[i] = make(chan *fanoutJob, queueSize)
+		go f.worker(f.workers[i])
+	}
+	return f
+}
+
+// calls send for each client on the workers. It blocks while the queues
+// of the workers are full and drops the message if the app is shutting down.
+func (f *fanout) submit(clients []*Client, send func(cl *Client)) {
+	if len(clients) == 0 || !f.app.beginFanout() {
+		return
+	}
+
+	shards := make([][]*Client, len(f.workers))
+	for _, cl := range clients {
+		i := f.shardOf(cl)
+		shards[i] = append(shards[i], cl)
+	}
+
+	var jobs []*fanoutJob
+	var workers []chan *fanoutJob
+	for i, shard := range shards {
+		for len(shard) > 0 {
+			n := f.batchSize
+			if n > len(shard) {
+				n = len(shard)
+			}
+			jobs = append(jobs, &fanoutJob{clients: shard[:n], send: send})
+			workers = append(workers, f.workers[i])
+			shard = shard[n:]
+		}
+	}
+
+	// the fanout is over once the last batch is served.
+	remaining := int32(len(jobs))
+	finish := func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			f.app.endFanout()
+		}
+	}
+	for i, job := range jobs {
+		job.finish = finish
+		atomic.AddInt64(&f.depth, 1)
+		select {
+		case workers[i] <- job:
+		case <-f.done:
+			atomic.AddInt64(&f.depth, -1)
+			finish()
+		}
+	}
+}
+
+func (f *fanout) shardOf(cl *Client) int {
+	h := fnv.New32a()
+	h.Write([]byte(cl.id))
+	return int(h.Sum32() % uint32(len(f.workers)))
+}
+
+func (f *fanout) worker(jobs chan *fanoutJob) {
+	for {
+		select {
+		case job := <-jobs:
+			atomic.AddInt64(&f.depth, -1)
+			for _, cl := range job.clients {
+				f.serve(job, cl)
+			}
+			job.finish()
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// calls send for a client and recovers from panics of user callbacks
+// (e.g. checkers), so that the worker keeps serving.
+func (f *fanout) serve(job *fanoutJob, cl *Client) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.app.config.Logger.Error("an error occured while sending a message to client " + cl.id)
+		}
+	}()
+	job.send(cl)
+}
+
+// returns how many batches wait for a worker.
+func (f *fanout) queueDepth() int64 {
+	return atomic.LoadInt64(&f.depth)
+}
+
+// stops the workers. Batches which are still queued are dropped. It may
+// be called more than once.
+func (f *fanout) stop() {
+	f.stopOnce.Do(func() {
+		close(f.done)
+	})
+}
@@ -0,0 +1,86 @@
+package panda
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFanout(t *testing.T) {
+	app := NewApp(Config{
+		FanoutWorkers:   3,
+		FanoutBatchSize: 2,
+		WriteQueueSize:  100,
+	})
+	var clients []*Client
+	for i := 0; i < 10; i++ {
+		clients = append(clients, newQueueTestClient(Config{WriteQueueSize: 100}))
+	}
+
+	for i := 0; i < 50; i++ {
+		f := &frame{frameType: websocket.TextMessage, data: []byte(strconv.Itoa(i))}
+		app.fanout.submit(clients, func(cl *Client) {
+			cl.enqueue(f)
+		})
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		app.fanouts.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("fanouts were not served")
+	}
+
+	for _, cl := range clients {
+		frames := queuedFrames(cl)
+		if len(frames) != 50 {
+			t.Fatalf("got %d frames, want 50", len(frames))
+		}
+		for i, data := range frames {
+			if data != strconv.Itoa(i) {
+				t.Fatalf("got frames out of order: %v", frames)
+			}
+		}
+	}
+	if depth := app.Metrics().FanoutQueueDepth; depth != 0 {
+		t.Errorf("got queue depth %d, want 0", depth)
+	}
+}
+
+func TestFanoutBlock(t *testing.T) {
+	// both clients are served by the single worker, so that the stuck
+	// one holds up the other one under the Block policy.
+	config := Config{
+		FanoutWorkers:      1,
+		WriteQueueSize:     1,
+		SlowConsumerPolicy: Block,
+		WriteQueueTimeout:  50 * time.Millisecond,
+	}
+	app := NewApp(config)
+	stuck := newQueueTestClient(config)
+	other := newQueueTestClient(config)
+	stuck.enqueue(&frame{frameType: websocket.TextMessage, data: []byte("0")})
+
+	f := &frame{frameType: websocket.TextMessage, data: []byte("1")}
+	start := time.Now()
+	app.fanout.submit([]*Client{stuck, other}, func(cl *Client) {
+		cl.enqueue(f)
+	})
+	select {
+	case <-other.outbound:
+	case <-time.After(time.Second):
+		t.Fatal("the other client did not get the frame")
+	}
+	if elapsed := time.Since(start); elapsed < config.WriteQueueTimeout {
+		t.Errorf("the other client got the frame after %v, want at least %v", elapsed, config.WriteQueueTimeout)
+	}
+	if got := stuck.app.Metrics().DroppedMessages; got != 1 {
+		t.Errorf("got %d dropped messages, want 1", got)
+	}
+}
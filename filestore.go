@@ -0,0 +1,456 @@
+package panda
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how large a segment of a FileStore grows before a new one is begun.
+	DefaultSegmentSize = 8 << 20
+	// how long the active segment of a FileStore's log is kept open after
+	// its last append.
+	DefaultIdleTimeout = time.Minute
+	segmentExt         = ".log"
+	// the length of a record's header: | length (4) | time (8) |.
+	recordHeaderLen = 4 + 8
+)
+
+var ErrStoreClosed = errors.New("message store is closed")
+
+type FileStoreConfig struct {
+	// the directory which the logs are kept in. Each channel has its own
+	// subdirectory of segments.
+	Dir string
+	// how large a segment grows before a new one is begun. The default
+	// is DefaultSegmentSize.
+	SegmentSize int64
+	// how long segments are kept after their last message. They are
+	// kept forever if it is zero.
+	Retention time.Duration
+	// how many segments each channel keeps at most. There is no limit
+	// if it is zero.
+	MaxSegments int
+	// to sync each segment to the disk after every append. It is slow
+	// but no message is lost if the machine crashes.
+	Sync bool
+	// how long the active segment of a channel is kept open after its
+	// last append. The default is DefaultIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// FileStore is a MessageStore which keeps the messages of each channel in
+// an append-only log on the disk, so that they survive restarts. A log is
+// split into segments which are named by the sequence number of their first
+// message; whole segments are dropped by Trim and by the retention.
+//
+// Records of a segment are laid out as:
+//
+//	| length (4) | time (8) | message |
+//
+// where length is the length of time and message, time is in Unix
+// nanoseconds and message is in the BINARY format (see message.go).
+//
+// The log of a channel is created by its first Append, so that reading
+// channels which have no messages leaves nothing on the disk.
+type FileStore struct {
+	config FileStoreConfig
+	// logs of the channels by their names. It is guarded by lock.
+	logs     map[string]*channelLog
+	lock     *sync.Mutex
+	isClosed bool
+}
+
+// the log of a channel. It is guarded by its lock.
+type channelLog struct {
+	lock *sync.Mutex
+	dir  string
+	// oldest first. The last one is the active segment.
+	segments []*segment
+	// the active segment if it is open for appending. It is opened by
+	// Append and closed by idleTimer once it is idle.
+	file      *os.File
+	idleTimer *time.Timer
+	isClosed  bool
+}
+
+type segment struct {
+	path     string
+	firstSeq uint64
+	lastSeq  uint64
+	lastTime time.Time
+	size     int64
+}
+
+// NewFileStore opens (or creates) a FileStore in config.Dir.
+func NewFileStore(config FileStoreConfig) (*FileStore, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSegmentSize
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{
+		config: config,
+		logs:   make(map[string]*channelLog),
+		lock:   &sync.Mutex{},
+	}, nil
+}
+
+func (s *FileStore) Append(message StoredMessage) error {
+	l, err := s.getLog(message.Message.Channel, true)
+	if err != nil {
+		return err
+	}
+	msg, err := message.Message.marshalBinary()
+	if err != nil {
+		return err
+	}
+	if uint64(len(msg)) > math.MaxUint32-8 {
+		return ErrMessageTooLong
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isClosed {
+		return ErrStoreClosed
+	}
+	// an error of the retention is returned once the message is kept.
+	var retentionErr error
+	var active *segment
+	if len(l.segments) > 0 {
+		active = l.segments[len(l.segments)-1]
+	}
+	switch {
+	case active == nil:
+		if active, err = l.rotate(message.Message.Seq); err != nil {
+			return err
+		}
+	case active.size >= s.config.SegmentSize && active.lastSeq != 0:
+		if active, err = l.rotate(message.Message.Seq); err != nil {
+			return err
+		}
+		retentionErr = s.applyRetention(l, message.Time)
+	case l.file == nil:
+		if l.file, err = os.OpenFile(active.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return err
+		}
+	}
+	l.closeWhenIdle(s.config.IdleTimeout)
+
+	record := make([]byte, 0, recordHeaderLen+len(msg))
+	record = binary.BigEndian.AppendUint32(record, uint32(8+len(msg)))
+	record = binary.BigEndian.AppendUint64(record, uint64(message.Time.UnixNano()))
+	record = append(record, msg...)
+	if _, err := l.file.Write(record); err != nil {
+		return err
+	}
+	if s.config.Sync {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if active.lastSeq == 0 {
+		active.firstSeq = message.Message.Seq
+	}
+	active.lastSeq = message.Message.Seq
+	active.lastTime = message.Time
+	active.size += int64(len(record))
+	return retentionErr
+}
+
+// Range reads the segments from the newest one back, so that it stops at
+// the first segment which is before since or from, or once it has limit
+// messages.
+func (s *FileStore) Range(channel string, since uint64, from time.Time, limit int) ([]StoredMessage, error) {
+	l, err := s.getLog(channel, false)
+	if l == nil || err != nil {
+		return nil, err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// the matching messages of each segment, newest segment first.
+	var segments [][]StoredMessage
+	count := 0
+	for i := len(l.segments) - 1; i >= 0 && (limit <= 0 || count < limit); i-- {
+		seg := l.segments[i]
+		if seg.lastSeq == 0 {
+			// the active segment may be empty.
+			continue
+		}
+		if seg.lastSeq <= since || seg.lastTime.Before(from) {
+			break
+		}
+		var messages []StoredMessage
+		err := readSegment(seg.path, func(m StoredMessage, end int64) {
+			if m.Message.Seq > since && !m.Time.Before(from) {
+				messages = append(messages, m)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, messages)
+		count += len(messages)
+	}
+	messages := make([]StoredMessage, 0, count)
+	for i := len(segments) - 1; i >= 0; i-- {
+		messages = append(messages, segments[i]...)
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+// Trim drops the segments (but the active one) whose messages are all
+// before the given sequence number or time.
+func (s *FileStore) Trim(channel string, before uint64, olderThan time.Time) error {
+	l, err := s.getLog(channel, false)
+	if l == nil || err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	drop := 0
+	for drop < len(l.segments)-1 {
+		seg := l.segments[drop]
+		if seg.lastSeq >= before && !seg.lastTime.Before(olderThan) {
+			break
+		}
+		drop++
+	}
+	return l.drop(drop)
+}
+
+func (s *FileStore) LastSeq(channel string) (uint64, error) {
+	l, err := s.getLog(channel, false)
+	if l == nil || err != nil {
+		return 0, err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if l.segments[i].lastSeq != 0 {
+			return l.segments[i].lastSeq, nil
+		}
+	}
+	return 0, nil
+}
+
+// Close closes the active segments. The store cannot be used after it.
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.isClosed = true
+	var err error
+	for _, l := range s.logs {
+		l.lock.Lock()
+		l.isClosed = true
+		if closeErr := l.closeFile(); closeErr != nil {
+			err = closeErr
+		}
+		l.lock.Unlock()
+	}
+	return err
+}
+
+// returns the log of the channel and opens it if it is not open yet. If
+// the log is not on the disk, it is created if create is set and nil is
+// returned otherwise.
+func (s *FileStore) getLog(channel string, create bool) (*channelLog, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed {
+		return nil, ErrStoreClosed
+	}
+	if l, ok := s.logs[channel]; ok {
+		return l, nil
+	}
+	// channel names may have any character, so that they are hex
+	// encoded to be valid directory names.
+	dir := filepath.Join(s.config.Dir, "channel-"+hex.EncodeToString([]byte(channel)))
+	if _, err := os.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !create {
+			return nil, nil
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	l, err := openChannelLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.logs[channel] = l
+	return l, nil
+}
+
+// drops the segments beyond MaxSegments and those older than Retention.
+// It must be called with the log's lock held.
+func (s *FileStore) applyRetention(l *channelLog, now time.Time) error {
+	drop := 0
+	if s.config.MaxSegments > 0 && len(l.segments) > s.config.MaxSegments {
+		drop = len(l.segments) - s.config.MaxSegments
+	}
+	for s.config.Retention > 0 && drop < len(l.segments)-1 && now.Sub(l.segments[drop].lastTime) > s.config.Retention {
+		drop++
+	}
+	return l.drop(drop)
+}
+
+// opens the log in dir. The segments are scanned to find their last
+// messages, and a record which was torn by a crash at the end of the last
+// segment is cut off. The active segment is opened by the next Append.
+func openChannelLog(dir string) (*channelLog, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &channelLog{lock: &sync.Mutex{}, dir: dir}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		firstSeq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{path: filepath.Join(dir, name), firstSeq: firstSeq})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].firstSeq < l.segments[j].firstSeq
+	})
+	for _, seg := range l.segments {
+		err := readSegment(seg.path, func(m StoredMessage, end int64) {
+			seg.lastSeq = m.Message.Seq
+			seg.lastTime = m.Time
+			seg.size = end
+		})
+		if err != nil && !errors.Is(err, ErrMalformedFrame) {
+			return nil, err
+		}
+	}
+	if len(l.segments) > 0 {
+		active := l.segments[len(l.segments)-1]
+		if err := os.Truncate(active.path, active.size); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// begins a new active segment whose first message is firstSeq. It must
+// be called with the log's lock held.
+func (l *channelLog) rotate(firstSeq uint64) (*segment, error) {
+	seg := &segment{path: filepath.Join(l.dir, fmt.Sprintf("%020d%s", firstSeq, segmentExt))}
+	file, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.segments = append(l.segments, seg)
+	return seg, nil
+}
+
+// closes the active segment once it is not appended to for timeout. It
+// must be called with the log's lock held.
+func (l *channelLog) closeWhenIdle(timeout time.Duration) {
+	if l.idleTimer != nil {
+		l.idleTimer.Reset(timeout)
+		return
+	}
+	l.idleTimer = time.AfterFunc(timeout, func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.closeFile()
+	})
+}
+
+// closes the active segment if it is open. It must be called with the
+// log's lock held.
+func (l *channelLog) closeFile() error {
+	if l.idleTimer != nil {
+		l.idleTimer.Stop()
+		l.idleTimer = nil
+	}
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// removes the first n segments. It must be called with the log's lock held.
+func (l *channelLog) drop(n int) error {
+	var err error
+	for _, seg := range l.segments[:n] {
+		if removeErr := os.Remove(seg.path); removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	l.segments = append(l.segments[:0], l.segments[n:]...)
+	return err
+}
+
+// reads the records of a segment one by one and passes each of them with
+// the offset of its end. It returns ErrMalformedFrame after the last
+// complete record if the segment ends with a torn one.
+func readSegment(path string, fn func(m StoredMessage, end int64)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	header := make([]byte, recordHeaderLen)
+	var end int64
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return ErrMalformedFrame
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length < 8 {
+			return ErrMalformedFrame
+		}
+		msg := make([]byte, length-8)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return ErrMalformedFrame
+		}
+		message, err := unmarshalBinaryMsg(msg)
+		if err != nil {
+			return err
+		}
+		end += 4 + int64(length)
+		fn(StoredMessage{
+			Message: message,
+			Time:    time.Unix(0, int64(binary.BigEndian.Uint64(header[4:]))),
+		}, end)
+	}
+}
@@ -0,0 +1,213 @@
+package panda
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMessageStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages survive reopening the store.
+	store, err = NewFileStore(FileStoreConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if seq, err := store.LastSeq("room"); err != nil || seq != 5 {
+		t.Errorf("got last seq %d, %v after reopening", seq, err)
+	}
+	messages, err := store.Range("room", 4, time.Time{}, 0)
+	if err != nil || len(messages) != 1 || messages[0].Message.Message != "5" {
+		t.Errorf("got %v, %v after reopening", messages, err)
+	}
+}
+
+func TestFileStoreSegments(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: dir, SegmentSize: 1, MaxSegments: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for seq := uint64(1); seq <= 6; seq++ {
+		err := store.Append(StoredMessage{Message: &Message{Channel: "room", Seq: seq}, Time: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := func() []string {
+		t.Helper()
+		matches, err := filepath.Glob(filepath.Join(dir, "*", "*"+segmentExt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+	// each message has its own segment and the oldest ones are dropped.
+	if got := len(segments()); got != 4 {
+		t.Errorf("got %d segments, want 4", got)
+	}
+	messages, err := store.Range("room", 0, time.Time{}, 0)
+	if err != nil || len(messages) != 4 || messages[0].Message.Seq != 3 {
+		t.Errorf("got %d messages from %v", len(messages), messages)
+	}
+
+	// the last messages are read back from the newest segment, so that
+	// the older ones are not read at all.
+	if err := os.WriteFile(segments()[0], []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = store.Range("room", 0, time.Time{}, 2)
+	if err != nil || len(messages) != 2 || messages[0].Message.Seq != 5 || messages[1].Message.Seq != 6 {
+		t.Errorf("got %v, %v, want the last 2 messages", messages, err)
+	}
+
+	if err := store.Trim("room", 5, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(segments()); got != 2 {
+		t.Errorf("got %d segments after trimming, want 2", got)
+	}
+
+	// a record which is torn by a crash is cut off on reopening.
+	last := segments()[len(segments())-1]
+	store.Close()
+	file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1})
+	file.Close()
+	store, err = NewFileStore(FileStoreConfig{Dir: dir, SegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Append(StoredMessage{Message: &Message{Channel: "room", Seq: 7}, Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err = store.Range("room", 0, time.Time{}, 0)
+	if err != nil || len(messages) != 3 || messages[2].Message.Seq != 7 {
+		t.Errorf("got %v, %v after a torn record", messages, err)
+	}
+}
+
+func TestFileStoreRetention(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: dir, SegmentSize: 1, Retention: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	start := time.Now()
+	for seq, sent := range []time.Time{start, start.Add(time.Second), start.Add(2 * time.Minute)} {
+		err := store.Append(StoredMessage{Message: &Message{Channel: "room", Seq: uint64(seq + 1)}, Time: sent})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the segments whose last message is older than Retention are dropped.
+	matches, err := filepath.Glob(filepath.Join(dir, "*", "*"+segmentExt))
+	if err != nil || len(matches) != 1 {
+		t.Errorf("got segments %v, %v, want the last one", matches, err)
+	}
+	messages, err := store.Range("room", 0, time.Time{}, 0)
+	if err != nil || len(messages) != 1 || messages[0].Message.Seq != 3 {
+		t.Errorf("got %v, %v, want the last message", messages, err)
+	}
+}
+
+// reading channels which have no log must not create one.
+func TestFileStoreLazyLogs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: dir, IdleTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	app := NewApp(Config{MessageStore: store})
+	for i := 0; i < 10; i++ {
+		app.channels.getChannelByName("room" + strconv.Itoa(i))
+		if _, err := store.Range("other"+strconv.Itoa(i), 0, time.Time{}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Trim("other"+strconv.Itoa(i), 1, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("got %d entries, %v, want none", len(entries), err)
+	}
+	store.lock.Lock()
+	logs := len(store.logs)
+	store.lock.Unlock()
+	if logs != 0 {
+		t.Errorf("got %d open logs, want none", logs)
+	}
+
+	// the active segment is closed once it is idle and opened again by
+	// the next append.
+	now := time.Now()
+	if err := store.Append(StoredMessage{Message: &Message{Channel: "room", Seq: 1}, Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	l, _ := store.getLog("room", false)
+	l.lock.Lock()
+	isOpen := l.file != nil
+	l.lock.Unlock()
+	if isOpen {
+		t.Error("expected the idle segment to be closed")
+	}
+	if err := store.Append(StoredMessage{Message: &Message{Channel: "room", Seq: 2}, Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := store.Range("room", 0, time.Time{}, 0)
+	if err != nil || len(messages) != 2 {
+		t.Errorf("got %v, %v, want both messages", messages, err)
+	}
+}
+
+func TestFileStoreRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(FileStoreConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(Config{MessageStore: store})
+	for i := 1; i <= 3; i++ {
+		app.Broadcast("room", strconv.Itoa(i))
+	}
+	store.Close()
+
+	store, err = NewFileStore(FileStoreConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	app = NewApp(Config{MessageStore: store})
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "room", Seq: 1})
+	for _, want := range []uint64{2, 3} {
+		if m := readTestMessage(t, conn); m.Seq != want {
+			t.Fatalf("got %+v, want the message %d", m, want)
+		}
+	}
+	app.Broadcast("room", "4")
+	if m := readTestMessage(t, conn); m.Seq != 4 {
+		t.Fatalf("got %+v, want the numbering to go on", m)
+	}
+}
@@ -1,8 +1,15 @@
 module github.com/techerfan/panda
 
-go 1.16
+go 1.23.0
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/gorilla/websocket v1.5.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.36.0 // indirect
 )
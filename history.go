@@ -0,0 +1,81 @@
+package panda
+
+import "time"
+
+// how the channels keep their history. No history is kept if store is nil.
+type historyConfig struct {
+	store MessageStore
+	// how many messages are kept; zero means no limit.
+	size int
+	// how long messages are kept; zero means no limit.
+	ttl time.Duration
+	// how many messages a subscribe replays at most.
+	maxReplay int
+}
+
+// keeps the message in the channel's history and lets go of the messages
+// which are beyond HistorySize or older than HistoryTTL. It must be called
+// with sendLock held.
+func (ch *channel) appendHistory(message *Message) {
+	now := time.Now()
+	if err := ch.history.store.Append(StoredMessage{Message: message, Time: now}); err != nil {
+		ch.logger.Error(err.Error())
+		return
+	}
+	if ch.history.size <= 0 && ch.history.ttl <= 0 {
+		return
+	}
+	var before uint64
+	if ch.history.size > 0 && message.Seq > uint64(ch.history.size) {
+		before = message.Seq - uint64(ch.history.size) + 1
+	}
+	var olderThan time.Time
+	if ch.history.ttl > 0 {
+		olderThan = now.Add(-ch.history.ttl)
+	}
+	if err := ch.history.store.Trim(ch.name, before, olderThan); err != nil {
+		ch.logger.Error(err.Error())
+	}
+}
+
+// returns the messages of the history whose sequence numbers are greater
+// than since (if it is set) and at most upTo, at most the last ones of them
+// (if it is set) and no more than maxReplay of them, in order. It does not
+// need sendLock, so that publishers do not wait for the store.
+func (ch *channel) replayHistory(since, upTo uint64, last int) []*Message {
+	// stores may keep messages longer than they are asked to.
+	if ch.history.size > 0 && upTo > uint64(ch.history.size) && since < upTo-uint64(ch.history.size) {
+		since = upTo - uint64(ch.history.size)
+	}
+	if last <= 0 || last > ch.history.maxReplay {
+		last = ch.history.maxReplay
+	}
+	var from time.Time
+	if ch.history.ttl > 0 {
+		from = time.Now().Add(-ch.history.ttl)
+	}
+	stored, err := ch.history.store.Range(ch.name, since, from, last)
+	if err != nil {
+		ch.logger.Error(err.Error())
+		return nil
+	}
+	// the messages after upTo are sent live. If they took the place of
+	// older ones, those are read once more.
+	newer := 0
+	for newer < len(stored) && stored[len(stored)-1-newer].Message.Seq > upTo {
+		newer++
+	}
+	if newer > 0 && len(stored) == last {
+		if stored, err = ch.history.store.Range(ch.name, since, from, last+newer); err != nil {
+			ch.logger.Error(err.Error())
+			return nil
+		}
+	}
+	messages := make([]*Message, 0, last)
+	for _, m := range stored {
+		if m.Message.Seq <= upTo && len(messages) < last {
+			messages = append(messages, m.Message)
+		}
+	}
+	return messages
+}
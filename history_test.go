@@ -0,0 +1,164 @@
+package panda
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	app := NewApp(Config{HistorySize: 3})
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+	for i := 1; i <= 5; i++ {
+		app.Broadcast("room", strconv.Itoa(i))
+	}
+
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "room", Last: 2, ID: "1"})
+	for _, want := range []uint64{4, 5} {
+		if m := readTestMessage(t, conn); m.Seq != want || m.Message != strconv.FormatUint(want, 10) {
+			t.Fatalf("got %+v, want the message %d", m, want)
+		}
+	}
+	if m := readTestMessage(t, conn); m.MsgType != Ack {
+		t.Fatalf("got %+v, want the Ack", m)
+	}
+	app.Broadcast("room", "6")
+	if m := readTestMessage(t, conn); m.Seq != 6 {
+		t.Fatalf("got %+v, want the live message", m)
+	}
+
+	otherConn, _ := dialTestClient(t, app, url)
+	writeTestMessage(t, otherConn, &Message{MsgType: Subscribe, Channel: "room", Seq: 5})
+	if m := readTestMessage(t, otherConn); m.Seq != 6 {
+		t.Fatalf("got %+v, want the messages after 5", m)
+	}
+}
+
+// the replay is not subject to SlowConsumerPolicy, although it is longer
+// than the queue.
+func TestReplayBeyondQueue(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{DropNewest, Block, Disconnect} {
+		app := NewApp(Config{
+			HistorySize:        100,
+			WriteQueueSize:     4,
+			SlowConsumerPolicy: policy,
+		})
+		_, url := newTestServer(t, app)
+		conn, client := dialTestClient(t, app, url)
+		for i := 1; i <= 50; i++ {
+			app.Broadcast("room", strconv.Itoa(i))
+		}
+
+		writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "room", Last: 50, ID: "1"})
+		for want := uint64(1); want <= 50; want++ {
+			if m := readTestMessage(t, conn); m.Seq != want {
+				t.Fatalf("got %+v, want the message %d", m, want)
+			}
+		}
+		if m := readTestMessage(t, conn); m.MsgType != Ack {
+			t.Fatalf("got %+v, want the Ack", m)
+		}
+		if got := app.Metrics().DroppedMessages; got != 0 {
+			t.Errorf("got %d dropped messages with policy %d, want none", got, policy)
+		}
+		if err := client.Context().Err(); err != nil {
+			t.Errorf("expected the client to stay connected with policy %d, got %v", policy, err)
+		}
+	}
+}
+
+func TestReplayTTL(t *testing.T) {
+	app := NewApp(Config{HistoryTTL: 50 * time.Millisecond})
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+	app.Broadcast("room", "1")
+	time.Sleep(80 * time.Millisecond)
+	app.Broadcast("room", "2")
+
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "room", Last: 10, ID: "1"})
+	if m := readTestMessage(t, conn); m.Seq != 2 {
+		t.Fatalf("got %+v, want the messages younger than the TTL", m)
+	}
+	if m := readTestMessage(t, conn); m.MsgType != Ack {
+		t.Fatalf("got %+v, want the Ack", m)
+	}
+}
+
+func TestMaxReplay(t *testing.T) {
+	app := NewApp(Config{HistorySize: 100, MaxReplay: 3})
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+	for i := 1; i <= 10; i++ {
+		app.Broadcast("room", strconv.Itoa(i))
+	}
+
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "room", Seq: 1, ID: "1"})
+	for _, want := range []uint64{8, 9, 10} {
+		if m := readTestMessage(t, conn); m.Seq != want {
+			t.Fatalf("got %+v, want the message %d", m, want)
+		}
+	}
+	if m := readTestMessage(t, conn); m.MsgType != Ack {
+		t.Fatalf("got %+v, want the Ack", m)
+	}
+}
+
+// a MessageStore whose Range waits until it is released.
+type blockingStore struct {
+	*MemoryStore
+	ranging chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Range(channel string, since uint64, from time.Time, limit int) ([]StoredMessage, error) {
+	s.ranging <- struct{}{}
+	<-s.release
+	return s.MemoryStore.Range(channel, since, from, limit)
+}
+
+// the history is read without holding up the publishers, and the messages
+// which are sent in the meantime are delivered after the replay.
+func TestReplayOutsideSendLock(t *testing.T) {
+	store := &blockingStore{
+		MemoryStore: NewMemoryStore(),
+		ranging:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	app := NewApp(Config{MessageStore: store})
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+	app.Broadcast("room", "1")
+	app.Broadcast("room", "2")
+
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "room", Last: 10, ID: "1"})
+	<-store.ranging
+	broadcast := make(chan struct{})
+	go func() {
+		app.Broadcast("room", "3")
+		close(broadcast)
+	}()
+	select {
+	case <-broadcast:
+	case <-time.After(time.Second):
+		t.Fatal("the broadcast waited for the replay")
+	}
+	close(store.release)
+
+	for _, want := range []uint64{1, 2} {
+		if m := readTestMessage(t, conn); m.Seq != want {
+			t.Fatalf("got %+v, want the message %d", m, want)
+		}
+	}
+	// the broadcast may reach the client before or after the Ack.
+	for acked, live := false, false; !acked || !live; {
+		switch m := readTestMessage(t, conn); {
+		case m.MsgType == Ack && !acked:
+			acked = true
+		case m.Seq == 3 && !live:
+			live = true
+		default:
+			t.Fatalf("got %+v, want the Ack and the message 3", m)
+		}
+	}
+}
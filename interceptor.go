@@ -0,0 +1,63 @@
+package panda
+
+import "fmt"
+
+// Interceptor is called for each frame which is about to be queued for a
+// client, whether it is sent by Send, Broadcast, Publish or as a reply
+// (e.g. an Ack). It gets a copy of the message which it may change (e.g.
+// to redact fields for the recipient or to add metadata) and returns the
+// message to send, or nil to veto the delivery. Each copy has its own Meta,
+// which is never nil, but Data is shared between the copies, so that it
+// must be replaced rather than changed in place. A frame whose interceptor
+// panics is dropped.
+type Interceptor func(client *Client, message *Message) *Message
+
+// Intercept adds interceptors of outbound frames. They run in the order
+// they are added. As the frame of a broadcast may differ per recipient, it
+// is encoded once per recipient when there are interceptors.
+func (a *App) Intercept(interceptors ...Interceptor) {
+	a.handlersLock.Lock()
+	defer a.handlersLock.Unlock()
+	a.interceptors = append(a.interceptors, interceptors...)
+}
+
+func (a *App) getInterceptors() []Interceptor {
+	a.handlersLock.RLock()
+	defer a.handlersLock.RUnlock()
+	return a.interceptors
+}
+
+// runs the interceptors on the frame for the client. It returns the
+// frame to send, which is re-encoded if there are interceptors, or nil
+// if the frame is vetoed.
+func (c *Client) intercept(f *frame) (intercepted *frame) {
+	interceptors := c.app.getInterceptors()
+	if len(interceptors) == 0 || f.message == nil {
+		return f
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Error(fmt.Sprintf("interceptor panicked on a frame for client %s: %v", c.id, r))
+			intercepted = nil
+		}
+	}()
+	copied := *f.message
+	// the frame is shared between its recipients, so that each of them
+	// gets its own Meta.
+	copied.Meta = make(map[string]string, len(f.message.Meta))
+	for key, value := range f.message.Meta {
+		copied.Meta[key] = value
+	}
+	message := &copied
+	for _, interceptor := range interceptors {
+		if message = interceptor(c, message); message == nil {
+			return nil
+		}
+	}
+	data, err := c.app.config.Codec.Encode(message)
+	if err != nil {
+		c.logger.Error(err.Error())
+		return nil
+	}
+	return &frame{frameType: f.frameType, data: data, message: message}
+}
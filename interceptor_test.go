@@ -0,0 +1,79 @@
+package panda
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIntercept(t *testing.T) {
+	app := NewApp(Config{
+		AuthenticationHandler: func(ticket string) (*time.Time, bool) {
+			return nil, true
+		},
+	})
+	app.Intercept(func(client *Client, message *Message) *Message {
+		if message.Message == "veto" {
+			return nil
+		}
+		message.Meta = map[string]string{"node": "eu-1"}
+		return message
+	})
+	app.Intercept(func(client *Client, message *Message) *Message {
+		if client.GetTicket() == "guest" {
+			message.Message = "[redacted]"
+		}
+		return message
+	})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url+"?ticket=member")
+	guestConn, guest := dialTestClient(t, app, url+"?ticket=guest")
+	client.Join("room")
+	guest.Join("room")
+	readTestMessage(t, conn)
+	readTestMessage(t, guestConn)
+
+	app.Broadcast("room", "veto")
+	app.Broadcast("room", "secret")
+	if m := readTestMessage(t, conn); m.Message != "secret" || m.Meta["node"] != "eu-1" || m.Seq != 2 {
+		t.Errorf("got %+v", m)
+	}
+	if m := readTestMessage(t, guestConn); m.Message != "[redacted]" || m.Meta["node"] != "eu-1" {
+		t.Errorf("got %+v", m)
+	}
+
+	// direct messages and replies go through the interceptors too.
+	client.Send("hello")
+	if m := readTestMessage(t, conn); m.Message != "hello" || m.Meta["node"] != "eu-1" {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestInterceptorMeta(t *testing.T) {
+	app := NewApp()
+	app.Intercept(func(client *Client, message *Message) *Message {
+		if message.Message == "panic" {
+			panic("interceptor failed")
+		}
+		// Meta is never nil and it is not shared with other recipients.
+		message.Meta["to"] = client.GetID()
+		return message
+	})
+	_, url := newTestServer(t, app)
+	conns := make(map[string]*websocket.Conn)
+	for i := 0; i < 3; i++ {
+		conn, client := dialTestClient(t, app, url)
+		client.Join("room")
+		readTestMessage(t, conn)
+		conns[client.GetID()] = conn
+	}
+
+	app.Broadcast("room", "panic")
+	app.Broadcast("room", "hello")
+	for id, conn := range conns {
+		if m := readTestMessage(t, conn); m.Message != "hello" || m.Meta["to"] != id || len(m.Meta) != 1 {
+			t.Errorf("got %+v for %s", m, id)
+		}
+	}
+}
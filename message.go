@@ -1,7 +1,11 @@
 package panda
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"math"
+	"sort"
 )
 
 type MessageType int
@@ -10,17 +14,89 @@ const (
 	Raw MessageType = iota
 	Subscribe
 	Unsubscribe
+	// sent to a client when its frame is rejected. Code tells why, Message
+	// describes it and ID is the ID of the rejected frame (if any).
+	Error
+	// sent to a client when its frame which has an ID is done (e.g. its
+	// subscription is live). ID is the ID of the frame.
+	Ack
+	// sent by a client to publish Message (or Data) over Channel.
+	Publish
+	// calls the method which is named by Channel with Message (or Data)
+	// as its payload. ID correlates the Response (or Error) frame with it.
+	// Both the server and clients may send requests.
+	Request
+	// answers the Request frame whose ID it has. Message is the result.
+	Response
+	// the first frame of each connection if sessions are enabled. Message
+	// is the session token and ID is the client's ID.
+	Session
+	// tells the subscribers of Channel that the client whose ID is ID has
+	// joined it, if PresenceEvents is set. Member is the client's metadata.
+	Joined
+	// tells the subscribers of Channel that the client whose ID is ID has
+	// left it, if PresenceEvents is set.
+	Left
 )
 
-type messageStruct struct {
-	MsgType MessageType `json:"msgType"`
-	Channel string      `json:"channel"`
-	Message string      `json:"message"`
+// ErrorCode tells a client why its frame was rejected in an Error frame.
+type ErrorCode string
+
+const (
+	// the frame could not be decoded.
+	CodeMalformedFrame ErrorCode = "malformed_frame"
+	// the msgType of the frame is not known to the server.
+	CodeUnknownType ErrorCode = "unknown_type"
+	// an authorizer (e.g. SubscribeAuthorizer) rejected the frame.
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// the client sent more frames than RateLimit allows.
+	CodeRateLimited ErrorCode = "rate_limited"
+	// no handler is registered for the method of a Request frame.
+	CodeUnknownMethod ErrorCode = "unknown_method"
+	// the handler of a Request frame returned an error.
+	CodeRPCFailed ErrorCode = "rpc_failed"
+	// the handler of a Request frame did not answer in RPCTimeout.
+	CodeTimeout ErrorCode = "timeout"
+	// the channel of the frame is not valid for it (e.g. a Publish frame
+	// over a channel pattern).
+	CodeInvalidChannel ErrorCode = "invalid_channel"
+)
+
+// Message is the envelope of every frame which is exchanged with
+// clients. Codecs encode and decode it.
+type Message struct {
+	MsgType MessageType `json:"msgType" xml:"msgType" msgpack:"msgType"`
+	Channel string      `json:"channel" xml:"channel" msgpack:"channel"`
+	Message string      `json:"message" xml:"message" msgpack:"message"`
+	// binary payload which is used instead of Message by the byte-slice
+	// methods (e.g. Client.SendBytes). Binary codecs send it as is and
+	// text codecs encode it in base64.
+	Data []byte `json:"data,omitempty" xml:"-" msgpack:"data,omitempty"`
+	// the position of the message in its channel. Messages of a channel
+	// are numbered from 1 and every subscriber gets them in this order.
+	// It is zero for messages which are not sent over a channel.
+	Seq uint64 `json:"seq,omitempty" xml:"seq,omitempty" msgpack:"seq,omitempty"`
+	// an optional ID which clients give their frames, so that replies
+	// (Ack and Error frames) can refer to them.
+	ID string `json:"id,omitempty" xml:"id,omitempty" msgpack:"id,omitempty"`
+	// why the frame which ID refers to was rejected. It is set only for
+	// Error frames.
+	Code ErrorCode `json:"code,omitempty" xml:"code,omitempty" msgpack:"code,omitempty"`
+	// envelope metadata (e.g. a server timestamp or a node ID) which
+	// interceptors may add to outbound messages.
+	Meta map[string]string `json:"meta,omitempty" xml:"-" msgpack:"meta,omitempty"`
+	// asks for the last messages of the channel in a Subscribe frame. They
+	// are replayed from the channel's history before the live ones. Seq of
+	// a Subscribe frame asks for the messages after it instead (or too).
+	Last int `json:"last,omitempty" xml:"last,omitempty" msgpack:"last,omitempty"`
+	// the metadata of the member which a Joined frame is about (see
+	// Client.SetMetadata).
+	Member map[string]string `json:"member,omitempty" xml:"-" msgpack:"member,omitempty"`
 }
 
-func newMessage(channel string, message string, msgType MessageType) *messageStruct {
+func newMessage(channel string, message string, msgType MessageType) *Message {
 
-	msg := &messageStruct{
+	msg := &Message{
 		MsgType: msgType,
 		Channel: channel,
 		Message: message,
@@ -28,7 +104,42 @@ func newMessage(channel string, message string, msgType MessageType) *messageStr
 	return msg
 }
 
-func (m *messageStruct) marshal() ([]byte, error) {
+func newBytesMessage(channel string, data []byte, msgType MessageType) *Message {
+	if data == nil {
+		// a nil Data means that the payload is Message.
+		data = []byte{}
+	}
+	return &Message{
+		MsgType: msgType,
+		Channel: channel,
+		Data:    data,
+	}
+}
+
+func newErrorMessage(channel string, id string, code ErrorCode, message string) *Message {
+	return &Message{
+		MsgType: Error,
+		Channel: channel,
+		Message: message,
+		ID:      id,
+		Code:    code,
+	}
+}
+
+func newAckMessage(channel string, id string) *Message {
+	return &Message{
+		MsgType: Ack,
+		Channel: channel,
+		ID:      id,
+	}
+}
+
+// reports whether the payload of the message is Data.
+func (m *Message) isBinary() bool {
+	return m.Data != nil
+}
+
+func (m *Message) marshal() ([]byte, error) {
 	msgJSON, err := json.Marshal(&m)
 	if err != nil {
 		return nil, err
@@ -36,10 +147,249 @@ func (m *messageStruct) marshal() ([]byte, error) {
 	return msgJSON, nil
 }
 
-func unmarshalMsg(msg []byte) (*messageStruct, error) {
-	message := &messageStruct{}
+func unmarshalMsg(msg []byte) (*Message, error) {
+	message := &Message{}
 	if err := json.Unmarshal(msg, message); err != nil {
 		return nil, err
 	}
 	return message, nil
 }
+
+// Binary frames (BinaryCodec) are laid out as:
+//
+//	| msgType (1) | flags (1) | channel length (2) | channel | optional fields | payload length (4) | payload |
+//
+// Lengths and numbers are unsigned big endian integers. Optional fields
+// are present only if their flags are set, in this order:
+//
+//	binaryFlagSeq:  | seq (8) |
+//	binaryFlagID:   | id length (2) | id |
+//	binaryFlagCode: | code length (2) | code |
+//	binaryFlagMeta: | entries (2) | key length (2) | key | value length (2) | value | ... |
+//	binaryFlagLast: | last (4) |
+//	binaryFlagMember: | entries (2) | key length (2) | key | value length (2) | value | ... |
+//
+// Entries of Meta and Member are sorted by their keys.
+// The payload is the message's Data if binaryFlagData is set and its
+// Message otherwise.
+const binaryHeaderLen = 1 + 1 + 2 + 4
+
+const (
+	binaryFlagData byte = 1 << iota
+	binaryFlagSeq
+	binaryFlagID
+	binaryFlagCode
+	binaryFlagMeta
+	binaryFlagLast
+	binaryFlagMember
+)
+
+var (
+	ErrMalformedFrame = errors.New("malformed binary frame")
+	ErrChannelTooLong = errors.New("channel name is too long for a binary frame")
+	ErrFieldTooLong   = errors.New("id, code, meta, last or member is too long for a binary frame")
+	ErrMessageTooLong = errors.New("message is too long for a binary frame")
+	ErrInvalidMsgType = errors.New("message type does not fit in a binary frame")
+)
+
+func (m *Message) marshalBinary() ([]byte, error) {
+	if m.MsgType < 0 || m.MsgType > math.MaxUint8 {
+		return nil, ErrInvalidMsgType
+	}
+	if len(m.Channel) > math.MaxUint16 {
+		return nil, ErrChannelTooLong
+	}
+	if len(m.ID) > math.MaxUint16 || len(m.Code) > math.MaxUint16 ||
+		m.Last < 0 || uint64(m.Last) > math.MaxUint32 {
+		return nil, ErrFieldTooLong
+	}
+	metaKeys, metaSize, ok := binaryMapLayout(m.Meta)
+	if !ok {
+		return nil, ErrFieldTooLong
+	}
+	memberKeys, memberSize, ok := binaryMapLayout(m.Member)
+	if !ok {
+		return nil, ErrFieldTooLong
+	}
+	var flags byte
+	payload := []byte(m.Message)
+	if m.isBinary() {
+		flags |= binaryFlagData
+		payload = m.Data
+	}
+	if uint64(len(payload)) > math.MaxUint32 {
+		return nil, ErrMessageTooLong
+	}
+	size := binaryHeaderLen + len(m.Channel) + len(payload)
+	if m.Seq != 0 {
+		flags |= binaryFlagSeq
+		size += 8
+	}
+	if m.ID != "" {
+		flags |= binaryFlagID
+		size += 2 + len(m.ID)
+	}
+	if m.Code != "" {
+		flags |= binaryFlagCode
+		size += 2 + len(m.Code)
+	}
+	if len(m.Meta) > 0 {
+		flags |= binaryFlagMeta
+		size += metaSize
+	}
+	if m.Last != 0 {
+		flags |= binaryFlagLast
+		size += 4
+	}
+	if len(m.Member) > 0 {
+		flags |= binaryFlagMember
+		size += memberSize
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, byte(m.MsgType), flags)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Channel)))
+	buf = append(buf, m.Channel...)
+	if flags&binaryFlagSeq != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, m.Seq)
+	}
+	if flags&binaryFlagID != 0 {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.ID)))
+		buf = append(buf, m.ID...)
+	}
+	if flags&binaryFlagCode != 0 {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(m.Code)))
+		buf = append(buf, m.Code...)
+	}
+	if flags&binaryFlagMeta != 0 {
+		buf = appendBinaryMap(buf, m.Meta, metaKeys)
+	}
+	if flags&binaryFlagLast != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(m.Last))
+	}
+	if flags&binaryFlagMember != 0 {
+		buf = appendBinaryMap(buf, m.Member, memberKeys)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	return buf, nil
+}
+
+// returns the sorted keys of a map of a binary frame and the size of its
+// entries. It returns false if the map does not fit in a frame.
+func binaryMapLayout(m map[string]string) ([]string, int, bool) {
+	if len(m) > math.MaxUint16 {
+		return nil, 0, false
+	}
+	keys := make([]string, 0, len(m))
+	size := 2
+	for key, value := range m {
+		if len(key) > math.MaxUint16 || len(value) > math.MaxUint16 {
+			return nil, 0, false
+		}
+		keys = append(keys, key)
+		size += 2 + len(key) + 2 + len(value)
+	}
+	sort.Strings(keys)
+	return keys, size, true
+}
+
+func appendBinaryMap(buf []byte, m map[string]string, keys []string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(keys)))
+	for _, key := range keys {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+		buf = append(buf, key...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(m[key])))
+		buf = append(buf, m[key]...)
+	}
+	return buf
+}
+
+// reads the fields of a binary frame one by one. Once the frame turns
+// out to be too short, every read returns zero values and err is set.
+type binaryReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil || len(r.buf) < n {
+		r.err = ErrMalformedFrame
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *binaryReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *binaryReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *binaryReader) uint64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+// reads a string which is prefixed by its length (2).
+func (r *binaryReader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+// reads a map which is prefixed by its number of entries (2). Each entry
+// takes at least 4 bytes, so that a count which the rest of the frame
+// cannot hold is rejected before anything is allocated for it.
+func (r *binaryReader) stringMap() map[string]string {
+	entries := int(r.uint16())
+	if entries > len(r.buf)/4 {
+		r.err = ErrMalformedFrame
+		return nil
+	}
+	m := make(map[string]string, entries)
+	for i := 0; i < entries && r.err == nil; i++ {
+		key := r.string()
+		m[key] = r.string()
+	}
+	return m
+}
+
+func unmarshalBinaryMsg(msg []byte) (*Message, error) {
+	r := &binaryReader{buf: msg}
+	head := r.next(2)
+	message := &Message{
+		MsgType: MessageType(head[0]),
+	}
+	flags := head[1]
+	message.Channel = r.string()
+	if flags&binaryFlagSeq != 0 {
+		message.Seq = r.uint64()
+	}
+	if flags&binaryFlagID != 0 {
+		message.ID = r.string()
+	}
+	if flags&binaryFlagCode != 0 {
+		message.Code = ErrorCode(r.string())
+	}
+	if flags&binaryFlagMeta != 0 {
+		message.Meta = r.stringMap()
+	}
+	if flags&binaryFlagLast != 0 {
+		message.Last = int(r.uint32())
+	}
+	if flags&binaryFlagMember != 0 {
+		message.Member = r.stringMap()
+	}
+	payloadLen := r.uint32()
+	if r.err != nil || uint64(len(r.buf)) != uint64(payloadLen) {
+		return nil, ErrMalformedFrame
+	}
+	if flags&binaryFlagData != 0 {
+		message.Data = append([]byte{}, r.buf...)
+	} else {
+		message.Message = string(r.buf)
+	}
+	return message, nil
+}
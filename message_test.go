@@ -2,11 +2,13 @@ package panda
 
 import (
 	"fmt"
+	"reflect"
+	"runtime"
 	"testing"
 )
 
 func TestMarshal(t *testing.T) {
-	msg := &messageStruct{
+	msg := &Message{
 		Channel: "sth",
 		Message: "My message",
 	}
@@ -54,3 +56,62 @@ func TestUnmarshal(t *testing.T) {
 		t.Error("Message type did not match")
 	}
 }
+
+func TestBinaryFrame(t *testing.T) {
+	msg := &Message{
+		MsgType: Subscribe,
+		Channel: "chat",
+		Message: "hello\x00world",
+	}
+	frame, err := msg.marshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) != binaryHeaderLen+len(msg.Channel)+len(msg.Message) {
+		t.Errorf("unexpected frame length %d", len(frame))
+	}
+
+	decoded, err := unmarshalBinaryMsg(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Errorf("got %+v, want %+v", decoded, msg)
+	}
+
+	msg = newErrorMessage("chat", "req-1", CodeRateLimited, "slow down")
+	msg.Seq = 7
+	frame, err = msg.marshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = unmarshalBinaryMsg(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Errorf("got %+v, want %+v", decoded, msg)
+	}
+
+	for _, malformed := range [][]byte{
+		nil,
+		frame[:binaryHeaderLen-1],
+		frame[:len(frame)-1],
+		append(frame, 0),
+		// more Member entries than the frame can hold.
+		{byte(Raw), binaryFlagMember, 0, 0, 0xff, 0xff, 0, 0, 0, 0},
+	} {
+		if _, err := unmarshalBinaryMsg(malformed); err != ErrMalformedFrame {
+			t.Errorf("expected ErrMalformedFrame for %v, got %v", malformed, err)
+		}
+	}
+
+	// the count of entries must not size the map before it is checked.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	unmarshalBinaryMsg([]byte{byte(Raw), binaryFlagMeta, 0, 0, 0xff, 0xff, 0, 0, 0, 0})
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<10 {
+		t.Errorf("allocated %d bytes for a 10-byte frame", allocated)
+	}
+}
@@ -0,0 +1,42 @@
+package panda
+
+import "sync/atomic"
+
+// Metrics is a snapshot of the app's counters.
+type Metrics struct {
+	// clients which were torn down because they missed their pongs
+	// or sent nothing before their read deadline.
+	TimedOutClients uint64
+	// frames which were dropped because a client's queue was full.
+	DroppedMessages uint64
+	// clients which were closed by the Disconnect policy.
+	SlowConsumerDisconnects uint64
+	// events which were dropped because a client's event queue was full.
+	DroppedEvents uint64
+	// batches of recipients which wait for a fanout worker.
+	FanoutQueueDepth int64
+}
+
+// keeps the app's counters. Fields are updated atomically.
+type metrics struct {
+	timedOutClients         uint64
+	droppedMessages         uint64
+	slowConsumerDisconnects uint64
+	droppedEvents           uint64
+}
+
+func (m *metrics) snapshot() Metrics {
+	return Metrics{
+		TimedOutClients:         atomic.LoadUint64(&m.timedOutClients),
+		DroppedMessages:         atomic.LoadUint64(&m.droppedMessages),
+		SlowConsumerDisconnects: atomic.LoadUint64(&m.slowConsumerDisconnects),
+		DroppedEvents:           atomic.LoadUint64(&m.droppedEvents),
+	}
+}
+
+// Metrics returns the current values of the app's counters.
+func (a *App) Metrics() Metrics {
+	m := a.metrics.snapshot()
+	m.FanoutQueueDepth = a.fanout.queueDepth()
+	return m
+}
@@ -0,0 +1,33 @@
+package panda
+
+// MessageHandler handles a frame which a client sent.
+type MessageHandler func(client *Client, message *Message)
+
+// Middleware wraps the handler of the frames which clients send. It can
+// inspect the frame, rewrite it before passing it to next, or drop it by
+// not calling next at all.
+type Middleware func(next MessageHandler) MessageHandler
+
+// Use adds middlewares to the chain which every decoded frame of a client
+// goes through before it is dispatched by its msgType (e.g. subscribed or
+// passed to the event handlers). Middlewares run in the order they are
+// added; the first one is the outermost.
+func (a *App) Use(middlewares ...Middleware) {
+	a.handlersLock.Lock()
+	defer a.handlersLock.Unlock()
+	a.middlewares = append(a.middlewares, middlewares...)
+	handler := MessageHandler(func(client *Client, message *Message) {
+		client.dispatch(message)
+	})
+	for i := len(a.middlewares) - 1; i >= 0; i-- {
+		handler = a.middlewares[i](handler)
+	}
+	a.inbound = handler
+}
+
+// returns the head of the middleware chain.
+func (a *App) inboundHandler() MessageHandler {
+	a.handlersLock.RLock()
+	defer a.handlersLock.RUnlock()
+	return a.inbound
+}
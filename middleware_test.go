@@ -0,0 +1,66 @@
+package panda
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUse(t *testing.T) {
+	app := NewApp()
+	var order []string
+	orderLock := &sync.Mutex{}
+	record := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(client *Client, message *Message) {
+				orderLock.Lock()
+				order = append(order, name)
+				orderLock.Unlock()
+				next(client, message)
+			}
+		}
+	}
+	dropSpam := func(next MessageHandler) MessageHandler {
+		return func(client *Client, message *Message) {
+			if message.Channel != "spam" {
+				next(client, message)
+			}
+		}
+	}
+	upper := func(next MessageHandler) MessageHandler {
+		return func(client *Client, message *Message) {
+			message.Message = strings.ToUpper(message.Message)
+			next(client, message)
+		}
+	}
+	app.Use(record("first"), record("second"))
+	app.Use(dropSpam, upper)
+
+	handled := make(chan string, 10)
+	handler := func(client *Client, channel string, payload string) {
+		handled <- channel + ":" + payload
+	}
+	app.Handle("spam", handler)
+	app.Handle("chat", handler)
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+
+	writeTestMessage(t, conn, newMessage("spam", "buy now", Raw))
+	writeTestMessage(t, conn, newMessage("chat", "hello", Raw))
+	select {
+	case got := <-handled:
+		if got != "chat:HELLO" {
+			t.Errorf("got %q, want %q", got, "chat:HELLO")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event was not handled")
+	}
+
+	orderLock.Lock()
+	defer orderLock.Unlock()
+	if want := []string{"first", "second", "first", "second"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
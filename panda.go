@@ -1,10 +1,15 @@
 package panda
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"net"
 	"net/http"
 	"os"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,15 +20,41 @@ const (
 	DefaultWebSocketPath = "/ws"
 	DefaultLogsHeader    = "Panda"
 	DefaultServerAddress = ":8000"
+	// reason sent in the close frame when the app shuts down.
+	DefaultShutdownCloseReason = "server is shutting down"
+	// how long writing a close frame may take if there is no
+	// other deadline (e.g. of the context passed to Shutdown).
+	DefaultCloseFrameTimeout = time.Second
+	// how long a client has to answer a ping if PingInterval is set.
+	DefaultPongTimeout = 10 * time.Second
+	// how many frames may wait to be written to a client.
+	DefaultWriteQueueSize = 256
+	// how long the Block policy waits for room in a client's queue.
+	DefaultWriteQueueTimeout = time.Second
+	// reason sent in the close frame when a slow client is disconnected.
+	DefaultSlowConsumerCloseReason = "slow consumer"
+	// how many recipients a fanout worker serves in one batch.
+	DefaultFanoutBatchSize = 256
+	// how many batches may wait for each fanout worker.
+	DefaultFanoutQueueSize = 1024
+	// how long an RPC may take.
+	DefaultRPCTimeout = 30 * time.Second
+	// how many events of a client may wait for its handlers.
+	DefaultEventQueueSize = 256
+	// how many messages of the history a subscribe replays at most.
+	DefaultMaxReplay = 1000
 )
 
 type CommunicationType int
 
 const (
 	JSON CommunicationType = iota
-	// not implemented yet
+	// frames are sent as binary messages with a length-prefixed
+	// header. See message.go for the layout.
 	BINARY
 	XML
+	MSGPACK
+	CBOR
 )
 
 var Upgrader = websocket.Upgrader{
@@ -37,13 +68,36 @@ var Upgrader = websocket.Upgrader{
 }
 
 type App struct {
-	config  Config
-	clients []*Client
-	newConn chan *Client
-	// to check if app listens on new connection
-	isListening bool
-	// to stop apps from listening on new connections
-	stopListening chan bool
+	config Config
+	// connected clients by their IDs. It is guarded by lock.
+	clients map[string]*Client
+	// clients by their session tokens. It is guarded by lock.
+	sessions map[string]*Client
+	channels *channels
+	fanout   *fanout
+	// called for each new client. It is guarded by lock.
+	onNewConnection func(client *Client)
+	// guards clients, onNewConnection, server and isShuttingDown.
+	lock   *sync.Mutex
+	server *http.Server
+	// set by Shutdown; no new connections or fanouts are accepted after it.
+	isShuttingDown bool
+	// counts in-flight fanouts so that Shutdown can wait for them.
+	fanouts sync.WaitGroup
+	metrics *metrics
+	// handlers of RPC methods and of events by their names, the
+	// middlewares of inbound frames, the interceptors of outbound frames
+	// and the presence callbacks. They are guarded by handlersLock.
+	rpcHandlers   map[string]RPCHandler
+	eventHandlers map[string]EventHandler
+	middlewares   []Middleware
+	interceptors  []Interceptor
+	onJoin        func(client *Client, channel string)
+	onLeave       func(client *Client, channel string)
+	// the head of the middleware chain. It is nil if there is no
+	// middleware.
+	inbound      MessageHandler
+	handlersLock *sync.RWMutex
 }
 
 type Config struct {
@@ -70,13 +124,110 @@ type Config struct {
 	TicketTokenExpirationHandler func(client *Client)
 	// to use a custom logger.
 	Logger logger.Logger
+	// close code and reason which are sent to every client when the app
+	// shuts down. Defaults are websocket.CloseGoingAway and
+	// DefaultShutdownCloseReason.
+	ShutdownCloseCode   int
+	ShutdownCloseReason string
+	// to encode messages by a custom codec. If it is nil, the codec
+	// which is registered for CommunicationType is used.
+	Codec Codec
+	// how often clients are pinged. Pings are disabled if it is zero.
+	PingInterval time.Duration
+	// how long a client has to answer a ping before it is destroyed.
+	// The default is DefaultPongTimeout. It is ignored if PingInterval
+	// is zero.
+	PongTimeout time.Duration
+	// how long the server waits for a frame (or a pong) from a client
+	// before destroying it. If it is zero, it is PingInterval plus
+	// PongTimeout when pings are enabled and there is no deadline
+	// otherwise.
+	ReadTimeout time.Duration
+	// how long writing a frame to a client may take. There is no
+	// deadline if it is zero.
+	WriteTimeout time.Duration
+	// how many frames may wait to be written to each client. The
+	// default is DefaultWriteQueueSize.
+	WriteQueueSize int
+	// what happens when a frame is sent to a client whose queue is
+	// full. The default is DropNewest.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// how long the Block policy waits for room in the queue. The
+	// default is DefaultWriteQueueTimeout. A fanout worker waits this
+	// long for each stuck client before it serves the next ones.
+	WriteQueueTimeout time.Duration
+	// close code and reason which are sent to clients which are closed
+	// by the Disconnect policy. Defaults are websocket.ClosePolicyViolation
+	// and DefaultSlowConsumerCloseReason.
+	SlowConsumerCloseCode   int
+	SlowConsumerCloseReason string
+	// how many workers deliver broadcasts. The default is the number
+	// of CPUs.
+	FanoutWorkers int
+	// how many recipients a worker serves in one batch. The default
+	// is DefaultFanoutBatchSize.
+	FanoutBatchSize int
+	// how many batches may wait for each worker before broadcasting
+	// blocks. The default is DefaultFanoutQueueSize.
+	FanoutQueueSize int
+	// decides whether a client may subscribe to a channel by a Subscribe
+	// frame. Client.Join is not checked. Everyone may subscribe if it is nil.
+	SubscribeAuthorizer Authorizer
+	// decides whether a client may publish over a channel by a Publish
+	// frame or Client.Publish. Everyone may publish if it is nil.
+	PublishAuthorizer Authorizer
+	// how many frames a client may send per second on average. Frames
+	// beyond it are rejected by Error frames. There is no limit if it
+	// is zero.
+	RateLimit float64
+	// how many frames a client may send at once. The default is
+	// RateLimit rounded up.
+	RateLimitBurst int
+	// how long an RPC may take, either way. The default is
+	// DefaultRPCTimeout.
+	RPCTimeout time.Duration
+	// how many events of each client may wait for the handlers and
+	// listeners. Events beyond it are dropped. The default is
+	// DefaultEventQueueSize.
+	EventQueueSize int
+	// how many of its last messages each channel keeps for replaying them
+	// to new subscribers which ask for them. There is no limit if it is zero.
+	HistorySize int
+	// how long the messages of a channel are kept for replaying them. There
+	// is no limit if it is zero.
+	HistoryTTL time.Duration
+	// where channels keep their history (e.g. a FileStore, so that it
+	// survives restarts). If it is nil and HistorySize or HistoryTTL is set,
+	// a MemoryStore is used. No history is kept if there is no store.
+	MessageStore MessageStore
+	// how many messages of the history a subscribe replays at most, so that
+	// a client cannot make the server load a whole store. If a client
+	// missed more, the last ones are replayed. The default is
+	// DefaultMaxReplay.
+	MaxReplay int
+	// how long the session of a client whose connection is lost is kept,
+	// so that the client can resume it by reconnecting with its session
+	// token. Sessions are disabled if it is zero.
+	SessionGracePeriod time.Duration
+	// to tell the subscribers of a channel whenever a client joins or
+	// leaves it by Joined and Left frames.
+	PresenceEvents bool
+	// to let clients subscribe to many channels at once by patterns with
+	// wildcard levels (e.g. "orders.*"). If it is false, "*" and ">" are
+	// plain characters of channel names.
+	ChannelPatterns bool
 }
 
 func NewApp(config ...Config) *App {
 	app := &App{
 		config:        Config{},
-		newConn:       make(chan *Client),
-		stopListening: make(chan bool),
+		clients:       make(map[string]*Client),
+		sessions:      make(map[string]*Client),
+		lock:          &sync.Mutex{},
+		metrics:       &metrics{},
+		rpcHandlers:   make(map[string]RPCHandler),
+		eventHandlers: make(map[string]EventHandler),
+		handlersLock:  &sync.RWMutex{},
 	}
 
 	if len(config) > 0 {
@@ -99,29 +250,166 @@ func NewApp(config ...Config) *App {
 		app.config.Logger = logger.New()
 	}
 
+	if app.config.WriteQueueSize <= 0 {
+		app.config.WriteQueueSize = DefaultWriteQueueSize
+	}
+
+	if app.config.WriteQueueTimeout == 0 {
+		app.config.WriteQueueTimeout = DefaultWriteQueueTimeout
+	}
+
+	if app.config.SlowConsumerCloseCode == 0 {
+		app.config.SlowConsumerCloseCode = websocket.ClosePolicyViolation
+	}
+
+	if app.config.SlowConsumerCloseReason == "" {
+		app.config.SlowConsumerCloseReason = DefaultSlowConsumerCloseReason
+	}
+
+	if app.config.PingInterval > 0 {
+		if app.config.PongTimeout == 0 {
+			app.config.PongTimeout = DefaultPongTimeout
+		}
+		if app.config.ReadTimeout == 0 {
+			app.config.ReadTimeout = app.config.PingInterval + app.config.PongTimeout
+		}
+	}
+
+	if app.config.Codec == nil {
+		codec, ok := getCodec(app.config.CommunicationType)
+		if !ok {
+			app.config.Logger.Error("no codec is registered for the communication type, JSON is used instead")
+			codec = JSONCodec{}
+		}
+		app.config.Codec = codec
+	}
+
+	if app.config.RPCTimeout <= 0 {
+		app.config.RPCTimeout = DefaultRPCTimeout
+	}
+
+	if app.config.EventQueueSize <= 0 {
+		app.config.EventQueueSize = DefaultEventQueueSize
+	}
+
+	if app.config.FanoutWorkers <= 0 {
+		app.config.FanoutWorkers = runtime.NumCPU()
+	}
+
+	if app.config.FanoutBatchSize <= 0 {
+		app.config.FanoutBatchSize = DefaultFanoutBatchSize
+	}
+
+	if app.config.FanoutQueueSize <= 0 {
+		app.config.FanoutQueueSize = DefaultFanoutQueueSize
+	}
+
+	if app.config.MessageStore == nil && (app.config.HistorySize > 0 || app.config.HistoryTTL > 0) {
+		app.config.MessageStore = NewMemoryStore()
+	}
+
+	if app.config.MaxReplay <= 0 {
+		app.config.MaxReplay = DefaultMaxReplay
+	}
+
+	app.fanout = newFanout(app, app.config.FanoutWorkers, app.config.FanoutBatchSize, app.config.FanoutQueueSize)
+	app.channels = newChannels(app.config.Logger, app.config.Codec, app.fanout, historyConfig{
+		store:     app.config.MessageStore,
+		size:      app.config.HistorySize,
+		ttl:       app.config.HistoryTTL,
+		maxReplay: app.config.MaxReplay,
+	}, app.config.ChannelPatterns)
+
+	if app.config.ShutdownCloseCode == 0 {
+		app.config.ShutdownCloseCode = websocket.CloseGoingAway
+	}
+
+	if app.config.ShutdownCloseReason == "" {
+		app.config.ShutdownCloseReason = DefaultShutdownCloseReason
+	}
+
 	return app
 }
 
-func (a *App) Serve() {
-	http.HandleFunc(a.config.WebSocketPath, func(rw http.ResponseWriter, r *http.Request) {
-		var destructionTime *time.Time
-		var ticket string
-		if a.config.AuthenticationHandler != nil {
-			queries := r.URL.Query()
-			ticket = queries.Get("ticket")
-			if ticket == "" {
-				return
-			}
-			var isTicketOk bool
-			destructionTime, isTicketOk = a.config.AuthenticationHandler(ticket)
-			if !isTicketOk {
-				rw.WriteHeader(http.StatusUnauthorized)
-				return
-			}
+// ServeHTTP authenticates the request and upgrades it to a WebSocket
+// connection. It lets the app be mounted on any router, behind any
+// middleware, or on a server which is owned by the caller.
+func (a *App) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if a.shuttingDown() {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var destructionTime *time.Time
+	var ticket string
+	if a.config.AuthenticationHandler != nil {
+		queries := r.URL.Query()
+		ticket = queries.Get("ticket")
+		if ticket == "" {
+			return
 		}
-		a.serveWs(rw, r, destructionTime, ticket)
-	})
+		var isTicketOk bool
+		destructionTime, isTicketOk = a.config.AuthenticationHandler(ticket)
+		if !isTicketOk {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	a.serveWs(rw, r, destructionTime, ticket)
+}
+
+// Serve is a convenience which listens on ServerAddress and serves
+// the app on WebSocketPath. Errors are logged.
+func (a *App) Serve() {
 	a.config.Logger.Info("WebSocket Server is up on: " + a.config.ServerAddress)
+	if err := a.ServeServer(a.newServer()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		a.config.Logger.Error(err.Error())
+	}
+}
+
+// ServeListener serves the app on WebSocketPath over the connections
+// accepted by l. TLS settings of the config are applied. It always returns
+// a non-nil error; after Shutdown the error is http.ErrServerClosed.
+func (a *App) ServeListener(l net.Listener) error {
+	server := a.newServer()
+	if !a.setServer(server) {
+		return http.ErrServerClosed
+	}
+	if a.config.IsTlSEnabled {
+		return server.ServeTLS(l, a.config.TLSCertPath, a.config.TlSKeyPath)
+	}
+	return server.Serve(l)
+}
+
+// ServeServer runs the app on a server which is owned by the caller.
+// If the server has no handler, the app is mounted on WebSocketPath.
+// The server is shut down by Shutdown. It always returns a non-nil
+// error; after Shutdown the error is http.ErrServerClosed.
+func (a *App) ServeServer(server *http.Server) error {
+	if server.Handler == nil {
+		server.Handler = a.newMux()
+	}
+	if !a.setServer(server) {
+		return http.ErrServerClosed
+	}
+	if a.config.IsTlSEnabled || server.TLSConfig != nil {
+		return server.ListenAndServeTLS(a.config.TLSCertPath, a.config.TlSKeyPath)
+	}
+	return server.ListenAndServe()
+}
+
+// makes a mux which serves the app on WebSocketPath.
+func (a *App) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(a.config.WebSocketPath, a)
+	return mux
+}
+
+// makes a server from the app's config.
+func (a *App) newServer() *http.Server {
+	server := &http.Server{
+		Addr:    a.config.ServerAddress,
+		Handler: a.newMux(),
+	}
 	if a.config.IsTlSEnabled {
 
 		caPem, err := os.ReadFile(a.config.TlsRootCaPath)
@@ -135,83 +423,145 @@ func (a *App) Serve() {
 			a.config.Logger.Error("could not append ca pem")
 		}
 
-		server := http.Server{
-			Addr: a.config.ServerAddress,
-			TLSConfig: &tls.Config{
-				RootCAs:            certPool,
-				InsecureSkipVerify: a.config.InsecureSkipVerify,
-			},
-		}
-		if err := server.ListenAndServeTLS(a.config.TLSCertPath, a.config.TlSKeyPath); err != nil {
-			a.config.Logger.Error(err.Error())
-		}
-	} else {
-		if err := http.ListenAndServe(a.config.ServerAddress, nil); err != nil {
-			a.config.Logger.Error(err.Error())
+		server.TLSConfig = &tls.Config{
+			RootCAs:            certPool,
+			InsecureSkipVerify: a.config.InsecureSkipVerify,
 		}
 	}
+	return server
+}
+
+// keeps the server so that Shutdown can stop it. It returns false
+// if the app is already shutting down.
+func (a *App) setServer(server *http.Server) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.isShuttingDown {
+		return false
+	}
+	a.server = server
+	return true
+}
+
+// Shutdown gracefully stops the app. It stops accepting new connections,
+// waits for in-flight channel fanouts to finish and then sends a close frame
+// with ShutdownCloseCode and ShutdownCloseReason to every client, behind the
+// frames which are already queued for it, before destroying it. If ctx is
+// done before that, clients are closed right away and ctx's error is returned.
+// Calling it again returns nil right away.
+func (a *App) Shutdown(ctx context.Context) error {
+	a.lock.Lock()
+	if a.isShuttingDown {
+		// the app is already shut down (or being shut down).
+		a.lock.Unlock()
+		return nil
+	}
+	a.isShuttingDown = true
+	server := a.server
+	a.lock.Unlock()
+
+	var err error
+	if server != nil {
+		// hijacked (upgraded) connections are not tracked by the server,
+		// so this only closes the listener and idle HTTP connections.
+		err = server.Shutdown(ctx)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		a.fanouts.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	deadline := time.Now().Add(DefaultCloseFrameTimeout)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d
+	}
+	closing := sync.WaitGroup{}
+	for _, cl := range a.GetClients() {
+		closing.Add(1)
+		go func(c *Client) {
+			defer closing.Done()
+			c.close(a.config.ShutdownCloseCode, a.config.ShutdownCloseReason, deadline)
+		}(cl)
+	}
+	closing.Wait()
+	a.channels.destroy()
+	a.fanout.stop()
+
+	return err
 }
 
 func (a *App) Broadcast(channelName string, message string, checker ...func(*Client) bool) {
-	getChannelsInstance(a.config.Logger).getChannelByName(channelName).sendMessageToClients(message, checker...)
+	a.channels.getChannelByName(channelName).sendMessageToClients(newMessage(channelName, message, Raw), checker...)
+}
+
+// BroadcastBytes is like Broadcast but sends a binary payload.
+func (a *App) BroadcastBytes(channelName string, data []byte, checker ...func(*Client) bool) {
+	a.channels.getChannelByName(channelName).sendMessageToClients(newBytesMessage(channelName, data, Raw), checker...)
 }
 
 func (a *App) BroadcastWithCallback(channelName string, callback func(*Client) string, checker ...func(*Client) bool) {
-	getChannelsInstance(a.config.Logger).getChannelByName(channelName).sendMessageToClientsByCallback(callback, checker...)
+	a.channels.getChannelByName(channelName).sendMessageToClientsByCallback(callback, checker...)
 }
 
 func (a *App) Destroy(channelName string) {
-	getChannelsInstance(a.config.Logger).getChannelByName(channelName).destroy()
+	a.channels.removeChannel(channelName)
 }
 
 func (a *App) Send(message string) {
-	for _, cl := range a.clients {
-		go func(c *Client) {
-			c.lock.Lock()
-			defer c.lock.Unlock()
-			msg, err := newMessage("", message, Raw).marshal()
-			if err != nil {
-				a.config.Logger.Error(err.Error())
-			}
-			err = c.conn.WriteMessage(websocket.TextMessage, msg)
-			if err != nil {
-				a.config.Logger.Error(err.Error())
-				a.removeClient(c)
-			}
-		}(cl)
+	a.sendToClients(newMessage("", message, Raw))
+}
+
+// SendBytes is like Send but sends a binary payload.
+func (a *App) SendBytes(data []byte) {
+	a.sendToClients(newBytesMessage("", data, Raw))
+}
+
+func (a *App) sendToClients(message *Message) {
+	msg, err := a.config.Codec.Encode(message)
+	if err != nil {
+		a.config.Logger.Error(err.Error())
+		return
+	}
+	f, err := newPreparedFrame(a.config.Codec.FrameType(), msg, message)
+	if err != nil {
+		a.config.Logger.Error(err.Error())
+		return
 	}
+	a.fanout.submit(a.GetClients(), func(cl *Client) {
+		cl.enqueue(f)
+	})
 }
 
 func (a *App) NewConnection(callback func(client *Client)) {
-	// it is not possible to have multiple listeners. so that we must stop
-	// other listeners (if any exists) and then make a new one.
-	if a.isListening {
-		a.stopListening <- true
-		a.isListening = true
-	}
-	go func(app *App) {
-		app.isListening = true
-		for {
-			select {
-			case newConn := <-app.newConn:
-				app.clients = append(app.clients, newConn)
-				go func() {
-					callback(newConn)
-				}()
-			case <-app.stopListening:
-				return
-			}
-		}
-	}(a)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// it is not possible to have multiple listeners, so that
+	// the new callback replaces the previous one (if any).
+	a.onNewConnection = callback
 }
 
 // returns a slice of current clients
 func (a *App) GetClients() []*Client {
-	return a.clients
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	clients := make([]*Client, 0, len(a.clients))
+	for _, cl := range a.clients {
+		clients = append(clients, cl)
+	}
+	return clients
 }
 
 // returns how many clients are connected to the server.
 func (a *App) GetClientsCount() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 	return len(a.clients)
 }
 
@@ -222,40 +572,81 @@ func (a *App) serveWs(rw http.ResponseWriter, r *http.Request, destructionTime *
 		return
 	}
 
+	if token := r.URL.Query().Get("session"); token != "" && a.config.SessionGracePeriod > 0 {
+		if cl := a.resumeSession(token, conn, ticket, destructionTime); cl != nil {
+			a.lock.Lock()
+			callback := a.onNewConnection
+			a.lock.Unlock()
+			if callback != nil {
+				go callback(cl)
+			}
+			return
+		}
+	}
+
 	newCl := newClient(a, a.config.Logger, conn, ticket)
+	callback, ok := a.addClient(newCl)
+	if !ok {
+		// the app started shutting down after the request was accepted.
+		newCl.closeNow(a.config.ShutdownCloseCode, a.config.ShutdownCloseReason)
+		return
+	}
+	newCl.start()
 
 	// to close client's connection after the specified time
 	// it is optionanl to set destruction time so that developer
 	// can use the package without authentication/authorization.
-	if destructionTime != nil {
-		timer := time.NewTimer(time.Until(*destructionTime))
-		go func() {
-			<-timer.C
-			a.removeClient(newCl)
-			if a.config.TicketTokenExpirationHandler != nil {
-				a.config.TicketTokenExpirationHandler(newCl)
-			}
-			err := newCl.Destroy()
-			if err != nil {
-				a.config.Logger.Error(err.Error())
-			}
-		}()
+	newCl.setExpiration(destructionTime)
+
+	if callback != nil {
+		go callback(newCl)
 	}
+}
 
-	// whenever a new client joins, we will send it over newConn channel
-	// but app must listens on new connections.
-	// we did this because if nobody listens on channel, Go will exit
-	// the program by code 1.
-	if a.isListening {
-		a.newConn <- newCl
+// registers a new client and returns the NewConnection callback. It
+// returns false if the app is shutting down and the client must be closed.
+func (a *App) addClient(c *Client) (func(client *Client), bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.isShuttingDown {
+		return nil, false
+	}
+	a.clients[c.id] = c
+	if c.session != "" {
+		a.sessions[c.session] = c
 	}
+	return a.onNewConnection, true
 }
 
 func (a *App) removeClient(c *Client) {
-	for i, cl := range a.clients {
-		if cl == c {
-			a.clients = append(a.clients[:i], a.clients[i+1:]...)
-			break
-		}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.clients[c.id] == c {
+		delete(a.clients, c.id)
+	}
+	if c.session != "" && a.sessions[c.session] == c {
+		delete(a.sessions, c.session)
 	}
 }
+
+func (a *App) shuttingDown() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.isShuttingDown
+}
+
+// registers a fanout so that Shutdown waits for it. It returns false
+// if the app is shutting down and the fanout must not be started.
+func (a *App) beginFanout() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.isShuttingDown {
+		return false
+	}
+	a.fanouts.Add(1)
+	return true
+}
+
+func (a *App) endFanout() {
+	a.fanouts.Done()
+}
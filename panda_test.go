@@ -0,0 +1,248 @@
+package panda
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestServer(t *testing.T, app *App) (*httptest.Server, string) {
+	t.Helper()
+	server := httptest.NewServer(app)
+	t.Cleanup(server.Close)
+	return server, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// connects to the app and returns the connection and its client. It
+// replaces the app's NewConnection callback.
+func dialTestClient(t *testing.T, app *App, url string) (*websocket.Conn, *Client) {
+	t.Helper()
+	connected := make(chan *Client, 1)
+	app.NewConnection(func(client *Client) {
+		connected <- client
+	})
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	select {
+	case client := <-connected:
+		return conn, client
+	case <-time.After(time.Second):
+		t.Fatal("client did not connect")
+	}
+	return nil, nil
+}
+
+// reads and decodes the next JSON frame of the connection.
+func readTestMessage(t *testing.T, conn *websocket.Conn) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := unmarshalMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// encodes the message as JSON and writes it to the connection.
+func writeTestMessage(t *testing.T, conn *websocket.Conn, m *Message) {
+	t.Helper()
+	msg, err := m.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waits up to a second for the condition to hold.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition did not hold in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Run("upgrades the connection", func(t *testing.T) {
+		app := NewApp()
+		connected := make(chan *Client, 1)
+		app.NewConnection(func(client *Client) {
+			connected <- client
+		})
+		_, url := newTestServer(t, app)
+
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		select {
+		case client := <-connected:
+			client.Send("hello")
+		case <-time.After(time.Second):
+			t.Fatal("client did not connect")
+		}
+
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := unmarshalMsg(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Message != "hello" {
+			t.Errorf("got %q, want %q", m.Message, "hello")
+		}
+	})
+
+	t.Run("rejects invalid tickets", func(t *testing.T) {
+		app := NewApp(Config{
+			AuthenticationHandler: func(ticket string) (*time.Time, bool) {
+				return nil, ticket == "valid"
+			},
+		})
+		_, url := newTestServer(t, app)
+
+		_, resp, err := websocket.DefaultDialer.Dial(url+"?ticket=invalid", nil)
+		if err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(url+"?ticket=valid", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	app := NewApp(Config{
+		ShutdownCloseCode:   websocket.CloseServiceRestart,
+		ShutdownCloseReason: "deploying",
+	})
+	connected := make(chan *Client, 1)
+	app.NewConnection(func(client *Client) {
+		connected <- client
+	})
+	_, url := newTestServer(t, app)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("client did not connect")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = conn.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("expected a close error, got %v", err)
+	}
+	if closeErr.Code != websocket.CloseServiceRestart || closeErr.Text != "deploying" {
+		t.Errorf("got close frame %d %q", closeErr.Code, closeErr.Text)
+	}
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("expected new connections to be refused after shutdown")
+	}
+	if err := app.Shutdown(ctx); err != nil {
+		t.Errorf("expected a second shutdown to succeed, got %v", err)
+	}
+}
+
+// clients connect, subscribe, unsubscribe and leave while messages are
+// broadcast. It is meant to be run with -race.
+func TestConcurrentClients(t *testing.T) {
+	app := NewApp()
+	app.NewConnection(func(client *Client) {
+		client.OnMessage(func(msg string) {
+			client.Publish("room", msg)
+		})
+	})
+	_, url := newTestServer(t, app)
+
+	done := make(chan struct{})
+	broadcasting := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		broadcasting.Add(1)
+		go func() {
+			defer broadcasting.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				app.Broadcast("room", "broadcast")
+				app.BroadcastWithCallback("room", func(c *Client) string { return c.GetID() })
+				app.Send("hello")
+				app.GetClientsCount()
+			}
+		}()
+	}
+
+	churning := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		churning.Add(1)
+		go func() {
+			defer churning.Done()
+			for j := 0; j < 5; j++ {
+				conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, msg := range []*Message{
+					newMessage("room", "", Subscribe),
+					newMessage("", "published", Raw),
+					newMessage("room", "", Unsubscribe),
+					newMessage("room", "", Subscribe),
+				} {
+					data, _ := msg.marshal()
+					if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+						t.Error(err)
+					}
+				}
+				conn.ReadMessage()
+				conn.Close()
+			}
+		}()
+	}
+	churning.Wait()
+	close(done)
+	broadcasting.Wait()
+}
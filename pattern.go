@@ -0,0 +1,117 @@
+package panda
+
+import (
+	"errors"
+	"strings"
+)
+
+// Channel names are hierarchical: their levels are separated by dots
+// (e.g. "orders.eu.42"). A channel pattern is a name which has wildcard
+// levels; "*" matches exactly one level and ">", which must be the last
+// level, matches one or more levels. For instance, "orders.*" matches
+// "orders.42" but not "orders.eu.42", while "orders.>" matches both.
+// Subscribers of a pattern get the messages of every channel it matches,
+// and a subscriber of several matching channels and patterns gets each
+// message once. Patterns are enabled by ChannelPatterns; otherwise the
+// wildcards are plain characters.
+const (
+	channelSeparator  = "."
+	wildcardLevel     = "*"
+	wildcardRemainder = ">"
+)
+
+// ErrPatternPublish is returned when a message is published over a
+// channel pattern rather than a channel.
+var ErrPatternPublish = errors.New("cannot publish over a channel pattern")
+
+// reports whether the channel name is a pattern.
+func isPattern(name string) bool {
+	return patternLevels(name) != nil
+}
+
+// returns the levels of the pattern, or nil if the name is not a pattern.
+func patternLevels(name string) []string {
+	levels := strings.Split(name, channelSeparator)
+	for i, level := range levels {
+		if level == wildcardLevel || (level == wildcardRemainder && i == len(levels)-1) {
+			return levels
+		}
+	}
+	return nil
+}
+
+// an immutable trie of patterns by their levels. Publishes match channel
+// names against it without a lock; it is rebuilt whenever a pattern is
+// added or removed.
+type patternIndex struct {
+	// the next levels by their names, but "*".
+	children map[string]*patternIndex
+	// the next level if it is "*".
+	any *patternIndex
+	// the patterns which end at this level.
+	patterns []*channel
+	// the patterns whose next level is the last one and ">".
+	remainders []*channel
+}
+
+// builds the index of the patterns.
+func newPatternIndex(patterns map[string]*channel) *patternIndex {
+	root := &patternIndex{}
+	for _, ch := range patterns {
+		node := root
+		for i, level := range ch.pattern {
+			if level == wildcardRemainder && i == len(ch.pattern)-1 {
+				node.remainders = append(node.remainders, ch)
+				node = nil
+				break
+			}
+			node = node.child(level)
+		}
+		if node != nil {
+			node.patterns = append(node.patterns, ch)
+		}
+	}
+	return root
+}
+
+// returns the node of the next level and adds it if there is none.
+func (idx *patternIndex) child(level string) *patternIndex {
+	if level == wildcardLevel {
+		if idx.any == nil {
+			idx.any = &patternIndex{}
+		}
+		return idx.any
+	}
+	if idx.children == nil {
+		idx.children = make(map[string]*patternIndex)
+	}
+	node, ok := idx.children[level]
+	if !ok {
+		node = &patternIndex{}
+		idx.children[level] = node
+	}
+	return node
+}
+
+// returns the patterns which match the name. Each pattern has a single
+// path in the trie, so that it is returned at most once.
+func (idx *patternIndex) match(name string) []*channel {
+	var matching []*channel
+	idx.collect(strings.Split(name, channelSeparator), &matching)
+	return matching
+}
+
+func (idx *patternIndex) collect(levels []string, matching *[]*channel) {
+	if len(levels) == 0 {
+		*matching = append(*matching, idx.patterns...)
+		return
+	}
+	// ">" matches the remaining levels, which are one or more.
+	*matching = append(*matching, idx.remainders...)
+	if node, ok := idx.children[levels[0]]; ok {
+		node.collect(levels[1:], matching)
+	}
+	if idx.any != nil {
+		idx.any.collect(levels[1:], matching)
+	}
+}
@@ -0,0 +1,113 @@
+package panda
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"orders.*", "orders.42", true},
+		{"orders.*", "orders.eu.42", false},
+		{"orders.*", "orders", false},
+		{"orders.*.paid", "orders.42.paid", true},
+		{"orders.*.paid", "orders.42.sent", false},
+		{"orders.>", "orders.42", true},
+		{"orders.>", "orders.eu.42", true},
+		{"orders.>", "orders", false},
+		{"*.>", "users.1", true},
+		{">", "users", true},
+	} {
+		ch := &channel{name: tc.pattern, pattern: patternLevels(tc.pattern)}
+		if ch.pattern == nil {
+			t.Fatalf("expected %q to be a pattern", tc.pattern)
+		}
+		index := newPatternIndex(map[string]*channel{tc.pattern: ch})
+		if got := len(index.match(tc.name)) == 1; got != tc.want {
+			t.Errorf("got %v for %q matching %q, want %v", got, tc.pattern, tc.name, tc.want)
+		}
+	}
+	// a name is matched by each of the patterns which match it once.
+	patterns := make(map[string]*channel)
+	for _, pattern := range []string{"orders.*", "orders.>", "*.42", ">", "orders.*.paid"} {
+		patterns[pattern] = &channel{name: pattern, pattern: patternLevels(pattern)}
+	}
+	var matched []string
+	for _, ch := range newPatternIndex(patterns).match("orders.42") {
+		matched = append(matched, ch.name)
+	}
+	sort.Strings(matched)
+	if want := []string{"*.42", ">", "orders.*", "orders.>"}; !reflect.DeepEqual(matched, want) {
+		t.Errorf("got %v, want %v", matched, want)
+	}
+
+	for _, name := range []string{"orders", "orders.42", "orders.>.42", "orders*", "a>"} {
+		if isPattern(name) {
+			t.Errorf("expected %q not to be a pattern", name)
+		}
+	}
+}
+
+func TestPatternSubscription(t *testing.T) {
+	app := NewApp(Config{ChannelPatterns: true})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "orders.*", ID: "1"})
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "orders.42", ID: "2"})
+	readTestMessage(t, conn)
+	readTestMessage(t, conn)
+	client.Join("orders.>")
+	readTestMessage(t, conn)
+
+	// the client gets each message once, although it is subscribed to
+	// the channel and to two patterns which match it.
+	app.Broadcast("orders.42", "paid")
+	app.Broadcast("users.1", "ignored")
+	app.Broadcast("orders.eu.7", "sent")
+	for _, want := range []*Message{
+		{Channel: "orders.42", Message: "paid", Seq: 1},
+		{Channel: "orders.eu.7", Message: "sent", Seq: 1},
+	} {
+		if m := readTestMessage(t, conn); m.MsgType != Raw || m.Channel != want.Channel || m.Message != want.Message || m.Seq != want.Seq {
+			t.Fatalf("got %+v, want %+v", m, want)
+		}
+	}
+
+	writeTestMessage(t, conn, &Message{MsgType: Publish, Channel: "orders.*", Message: "nope", ID: "3"})
+	if m := readTestMessage(t, conn); m.MsgType != Error || m.Code != CodeInvalidChannel || m.ID != "3" {
+		t.Fatalf("got %+v, want an invalid_channel error", m)
+	}
+
+	client.Leave("orders.>")
+	readTestMessage(t, conn)
+	writeTestMessage(t, conn, &Message{MsgType: Unsubscribe, Channel: "orders.*", ID: "4"})
+	readTestMessage(t, conn)
+	app.Broadcast("orders.1", "unsubscribed")
+	app.Broadcast("orders.42", "subscribed")
+	if m := readTestMessage(t, conn); m.Channel != "orders.42" || m.Message != "subscribed" {
+		t.Fatalf("got %+v, want the message of orders.42 only", m)
+	}
+}
+
+func TestPatternsDisabled(t *testing.T) {
+	app := NewApp()
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+	writeTestMessage(t, conn, &Message{MsgType: Subscribe, Channel: "orders.*", ID: "1"})
+	readTestMessage(t, conn)
+
+	// the wildcard is a plain character of the channel's name.
+	app.Broadcast("orders.42", "other channel")
+	if err := client.Publish("orders.*", "same channel"); err != nil {
+		t.Fatal(err)
+	}
+	if m := readTestMessage(t, conn); m.Channel != "orders.*" || m.Message != "same channel" {
+		t.Fatalf("got %+v, want the message of orders.*", m)
+	}
+}
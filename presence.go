@@ -0,0 +1,98 @@
+package panda
+
+import "sort"
+
+// Member is a client which is subscribed to a channel.
+type Member struct {
+	ID       string
+	Metadata map[string]string
+}
+
+// Presence returns the members of a channel, sorted by their IDs. It
+// returns no members if the channel does not exist.
+func (a *App) Presence(channelName string) []Member {
+	ch, ok := a.channels.lookupChannel(channelName)
+	if !ok {
+		return []Member{}
+	}
+	clients := ch.getClients()
+	members := make([]Member, 0, len(clients))
+	for _, cl := range clients {
+		members = append(members, Member{ID: cl.id, Metadata: cl.Metadata()})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// OnJoin sets the callback which is called whenever a client subscribes
+// to a channel. It is called on the goroutine which subscribes the client
+// (e.g. its reader), so that it must not block. The new callback replaces
+// the previous one (if any).
+func (a *App) OnJoin(callback func(client *Client, channel string)) {
+	a.handlersLock.Lock()
+	defer a.handlersLock.Unlock()
+	a.onJoin = callback
+}
+
+// OnLeave sets the callback which is called whenever a client unsubscribes
+// from a channel or is destroyed. Like OnJoin, it must not block. The new
+// callback replaces the previous one (if any).
+func (a *App) OnLeave(callback func(client *Client, channel string)) {
+	a.handlersLock.Lock()
+	defer a.handlersLock.Unlock()
+	a.onLeave = callback
+}
+
+// SetMetadata sets the metadata which members of the client's channels
+// see by presence (e.g. a user name). Set it before the client joins
+// channels, so that Joined frames carry it.
+func (c *Client) SetMetadata(metadata map[string]string) {
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.metadata = copied
+}
+
+// Metadata returns a copy of the client's metadata.
+func (c *Client) Metadata() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	metadata := make(map[string]string, len(c.metadata))
+	for key, value := range c.metadata {
+		metadata[key] = value
+	}
+	return metadata
+}
+
+// tells the subscribers and the OnJoin callback that the client has
+// joined the channel.
+func (c *Client) joined(ch *channel) {
+	if c.app.config.PresenceEvents {
+		ch.sendPresence(&Message{MsgType: Joined, Channel: ch.name, ID: c.id, Member: c.Metadata()})
+	}
+	c.app.handlersLock.RLock()
+	onJoin := c.app.onJoin
+	c.app.handlersLock.RUnlock()
+	if onJoin != nil {
+		onJoin(c, ch.name)
+	}
+}
+
+// tells the subscribers and the OnLeave callback that the client has
+// left the channel.
+func (c *Client) left(ch *channel) {
+	if c.app.config.PresenceEvents {
+		ch.sendPresence(&Message{MsgType: Left, Channel: ch.name, ID: c.id})
+	}
+	c.app.handlersLock.RLock()
+	onLeave := c.app.onLeave
+	c.app.handlersLock.RUnlock()
+	if onLeave != nil {
+		onLeave(c, ch.name)
+	}
+}
@@ -0,0 +1,84 @@
+package panda
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	app := NewApp(Config{PresenceEvents: true})
+	// interceptors own Meta, which must not wipe the member's metadata.
+	app.Intercept(func(client *Client, message *Message) *Message {
+		message.Meta = map[string]string{"node": "eu-1"}
+		return message
+	})
+	var lock sync.Mutex
+	var events []string
+	app.OnJoin(func(client *Client, channel string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, "join "+client.Metadata()["name"]+" "+channel)
+	})
+	app.OnLeave(func(client *Client, channel string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, "leave "+client.Metadata()["name"]+" "+channel)
+	})
+	_, url := newTestServer(t, app)
+
+	aliceConn, alice := dialTestClient(t, app, url)
+	alice.SetMetadata(map[string]string{"name": "alice"})
+	alice.Join("room")
+	if m := readTestMessage(t, aliceConn); m.MsgType != Subscribe {
+		t.Fatalf("got %+v, want the Subscribe frame of Join", m)
+	}
+	if m := readTestMessage(t, aliceConn); m.MsgType != Joined || m.ID != alice.GetID() || m.Member["name"] != "alice" {
+		t.Fatalf("got %+v, want alice's Joined frame", m)
+	}
+
+	_, bob := dialTestClient(t, app, url)
+	bob.SetMetadata(map[string]string{"name": "bob"})
+	bob.Join("room")
+	if m := readTestMessage(t, aliceConn); m.MsgType != Joined || m.Channel != "room" || m.ID != bob.GetID() || m.Member["name"] != "bob" {
+		t.Fatalf("got %+v, want bob's Joined frame", m)
+	}
+	members := app.Presence("room")
+	if len(members) != 2 {
+		t.Fatalf("got members %+v, want alice and bob", members)
+	}
+	for _, member := range members {
+		if member.ID == bob.GetID() && member.Metadata["name"] != "bob" {
+			t.Errorf("got %+v, want bob's metadata", member)
+		}
+	}
+
+	// joining twice is not a new presence.
+	bob.Join("room")
+	bob.Destroy()
+	if m := readTestMessage(t, aliceConn); m.MsgType != Left || m.ID != bob.GetID() {
+		t.Fatalf("got %+v, want bob's Left frame", m)
+	}
+	if members := app.Presence("room"); len(members) != 1 || members[0].ID != alice.GetID() {
+		t.Errorf("got members %+v, want alice", members)
+	}
+	alice.Leave("room")
+
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{"join alice room", "join bob room", "leave bob room", "leave alice room"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got events %v, want %v", events, want)
+	}
+}
+
+// asking about a channel which does not exist must not create it.
+func TestPresenceUnknownChannel(t *testing.T) {
+	app := NewApp()
+	if members := app.Presence("nowhere"); members == nil || len(members) != 0 {
+		t.Errorf("got members %#v, want an empty slice", members)
+	}
+	if _, ok := app.channels.lookupChannel("nowhere"); ok {
+		t.Error("expected the channel not to be created")
+	}
+}
@@ -0,0 +1,50 @@
+package panda
+
+import (
+	"math"
+	"time"
+)
+
+// a token bucket which limits the frames of a client. It is used by the
+// client's reader only, so that it needs no lock. A nil limiter allows
+// every frame.
+type rateLimiter struct {
+	// tokens which are added per second.
+	rate  float64
+	burst float64
+	// tokens which are left at last.
+	tokens float64
+	last   time.Time
+}
+
+// makes a limiter which allows rate frames per second on average and
+// burst frames at once. It returns nil if rate is not positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// takes a token if there is one.
+func (l *rateLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,158 @@
+package panda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// RPCHandler answers a Request frame of a client. The context is done when
+// RPCTimeout passes or the client is destroyed. If it returns an error, the
+// client gets an Error frame instead of a Response frame.
+type RPCHandler func(ctx context.Context, client *Client, payload string) (string, error)
+
+// RPCError is an error which is sent in an Error frame in reply to a
+// request. Handlers can return it to choose the code of the frame, and
+// Client.Call returns it when the client answers by an Error frame.
+type RPCError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc failed (%s): %s", e.Code, e.Message)
+}
+
+var ErrClientDestroyed = errors.New("client is destroyed")
+
+// HandleRPC registers the handler of a method which clients call by
+// Request frames. The new handler replaces the previous one (if any).
+func (a *App) HandleRPC(method string, handler RPCHandler) {
+	a.handlersLock.Lock()
+	defer a.handlersLock.Unlock()
+	a.rpcHandlers[method] = handler
+}
+
+func (a *App) getRPCHandler(method string) (RPCHandler, bool) {
+	a.handlersLock.RLock()
+	defer a.handlersLock.RUnlock()
+	handler, ok := a.rpcHandlers[method]
+	return handler, ok
+}
+
+// answers a Request frame of the client. The handler runs on its own
+// goroutine, so that it does not hold up the reader.
+func (c *Client) handleRequest(request *Message) {
+	handler, ok := c.app.getRPCHandler(request.Channel)
+	if !ok {
+		c.sendError(request, CodeUnknownMethod, "unknown method "+request.Channel)
+		return
+	}
+	payload := request.Message
+	if request.isBinary() {
+		payload = string(request.Data)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(c.ctx, c.app.config.RPCTimeout)
+		defer cancel()
+
+		type reply struct {
+			result string
+			err    error
+		}
+		replied := make(chan reply, 1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					replied <- reply{err: fmt.Errorf("handler panicked: %v", r)}
+				}
+			}()
+			result, err := handler(ctx, c, payload)
+			replied <- reply{result, err}
+		}()
+
+		select {
+		case r := <-replied:
+			var rpcErr *RPCError
+			switch {
+			case errors.As(r.err, &rpcErr):
+				c.sendError(request, rpcErr.Code, rpcErr.Message)
+			case r.err != nil:
+				c.sendError(request, CodeRPCFailed, r.err.Error())
+			default:
+				c.send(&Message{
+					MsgType: Response,
+					Channel: request.Channel,
+					Message: r.result,
+					ID:      request.ID,
+				})
+			}
+		case <-ctx.Done():
+			// the handler's reply is dropped if it comes later.
+			c.sendError(request, CodeTimeout, "method "+request.Channel+" timed out")
+		}
+	}()
+}
+
+// Call calls a method of the client by a Request frame and returns the
+// payload of its Response frame. If the client answers by an Error frame,
+// the error is an *RPCError. The call is given up when ctx is done, when
+// RPCTimeout passes (if ctx has no deadline) or when the client is
+// destroyed.
+func (c *Client) Call(ctx context.Context, method string, payload string) (string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.app.config.RPCTimeout)
+		defer cancel()
+	}
+
+	id := makeId()
+	replied := make(chan *Message, 1)
+	c.callsLock.Lock()
+	c.calls[id] = replied
+	c.callsLock.Unlock()
+	defer func() {
+		c.callsLock.Lock()
+		delete(c.calls, id)
+		c.callsLock.Unlock()
+	}()
+
+	c.send(&Message{
+		MsgType: Request,
+		Channel: method,
+		Message: payload,
+		ID:      id,
+	})
+
+	select {
+	case reply := <-replied:
+		if reply.MsgType == Error {
+			return "", &RPCError{Code: reply.Code, Message: reply.Message}
+		}
+		if reply.isBinary() {
+			return string(reply.Data), nil
+		}
+		return reply.Message, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-c.ctx.Done():
+		return "", ErrClientDestroyed
+	}
+}
+
+// passes a Response or Error frame of the client to the call which is
+// waiting for it. It returns false if no call is waiting for it.
+func (c *Client) resolveCall(reply *Message) bool {
+	if reply.ID == "" {
+		return false
+	}
+	c.callsLock.Lock()
+	replied, ok := c.calls[reply.ID]
+	delete(c.calls, reply.ID)
+	c.callsLock.Unlock()
+	if ok {
+		replied <- reply
+	}
+	return ok
+}
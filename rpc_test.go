@@ -0,0 +1,99 @@
+package panda
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandleRPC(t *testing.T) {
+	app := NewApp(Config{RPCTimeout: 50 * time.Millisecond})
+	app.HandleRPC("upper", func(ctx context.Context, client *Client, payload string) (string, error) {
+		return strings.ToUpper(payload), nil
+	})
+	app.HandleRPC("fail", func(ctx context.Context, client *Client, payload string) (string, error) {
+		return "", errors.New("no such order")
+	})
+	app.HandleRPC("slow", func(ctx context.Context, client *Client, payload string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	_, url := newTestServer(t, app)
+	conn, _ := dialTestClient(t, app, url)
+
+	for _, tc := range []struct {
+		method  string
+		msgType MessageType
+		code    ErrorCode
+		result  string
+	}{
+		{"upper", Response, "", "ORDER 42"},
+		{"fail", Error, CodeRPCFailed, "no such order"},
+		{"slow", Error, CodeTimeout, "method slow timed out"},
+		{"missing", Error, CodeUnknownMethod, "unknown method missing"},
+	} {
+		writeTestMessage(t, conn, &Message{MsgType: Request, Channel: tc.method, Message: "order 42", ID: tc.method})
+		m := readTestMessage(t, conn)
+		if m.MsgType != tc.msgType || m.Code != tc.code || m.ID != tc.method || m.Message != tc.result {
+			t.Errorf("%s: got %+v", tc.method, m)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	app := NewApp()
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+
+	// the test client answers "ping" and rejects everything else.
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			m, err := unmarshalMsg(msg)
+			if err != nil || m.MsgType != Request {
+				continue
+			}
+			reply := &Message{MsgType: Response, Channel: m.Channel, Message: "pong", ID: m.ID}
+			if m.Channel != "ping" {
+				reply = newErrorMessage(m.Channel, m.ID, CodeUnknownMethod, "unknown")
+			} else if m.Message == "ignore" {
+				continue
+			}
+			msg, _ = reply.marshal()
+			conn.WriteMessage(websocket.TextMessage, msg)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := client.Call(ctx, "ping", "")
+	if err != nil || result != "pong" {
+		t.Errorf("got %q, %v", result, err)
+	}
+
+	var rpcErr *RPCError
+	if _, err := client.Call(ctx, "missing", ""); !errors.As(err, &rpcErr) || rpcErr.Code != CodeUnknownMethod {
+		t.Errorf("got error %v, want an RPCError of %s", err, CodeUnknownMethod)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelShort()
+	if _, err := client.Call(short, "ping", "ignore"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		client.Destroy()
+	}()
+	if _, err := client.Call(ctx, "ping", "ignore"); !errors.Is(err, ErrClientDestroyed) {
+		t.Errorf("got error %v, want %v", err, ErrClientDestroyed)
+	}
+}
@@ -0,0 +1,122 @@
+package panda
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// makes a random token which cannot be guessed.
+func makeSessionToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("[Client]: cannot generate session token: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// makes the Session frame which tells the client its session token and
+// ID. It is the first frame of each connection.
+func (c *Client) sessionFrame() *frame {
+	message := &Message{MsgType: Session, Message: c.session, ID: c.id}
+	msg, err := c.app.config.Codec.Encode(message)
+	if err != nil {
+		c.logger.Error(err.Error())
+		return nil
+	}
+	return &frame{frameType: c.app.config.Codec.FrameType(), data: msg, message: message}
+}
+
+// Resumed reports whether the current connection of the client resumed
+// its session rather than opened it.
+func (c *Client) Resumed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.isResumed
+}
+
+func (c *Client) detached() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.isDetached
+}
+
+// tears down a connection which is lost. If sessions are enabled, the
+// client keeps its subscriptions and queues the frames which are sent to it
+// for SessionGracePeriod, so that its session can be resumed; otherwise (or
+// if it left for good) the client is destroyed. A connection which is
+// already replaced is ignored.
+func (c *Client) connectionLost(conn *websocket.Conn, isLeaving bool) {
+	if c.session == "" || isLeaving || c.app.shuttingDown() {
+		c.lock.Lock()
+		isCurrent := c.conn == conn
+		c.lock.Unlock()
+		if isCurrent {
+			c.Destroy()
+		}
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.isDestroyed || c.isDetached || c.conn != conn {
+		return
+	}
+	conn.Close()
+	close(c.connDone)
+	c.isDetached = true
+	var timer *time.Timer
+	timer = time.AfterFunc(c.app.config.SessionGracePeriod, func() {
+		c.lock.Lock()
+		isExpired := c.isDetached && c.graceTimer == timer
+		c.lock.Unlock()
+		if isExpired {
+			c.Destroy()
+		}
+	})
+	c.graceTimer = timer
+}
+
+// moves the client's session to a new connection, which brings its own
+// ticket and expiration. If the old connection is not lost yet, it is
+// closed. It returns false if the client is destroyed.
+func (c *Client) resume(conn *websocket.Conn, ticket string, expiration *time.Time) bool {
+	c.lock.Lock()
+	if c.isDestroyed {
+		c.lock.Unlock()
+		return false
+	}
+	if c.isDetached {
+		c.graceTimer.Stop()
+		c.graceTimer = nil
+	} else {
+		c.conn.Close()
+		close(c.connDone)
+	}
+	c.isDetached = false
+	c.isResumed = true
+	c.ticket = ticket
+	c.conn = conn
+	c.connDone = make(chan struct{})
+	connDone := c.connDone
+	c.lock.Unlock()
+
+	c.setExpiration(expiration)
+	c.run(conn, connDone)
+	return true
+}
+
+// resumes the session of the token on the connection and returns its
+// client. It returns nil if there is no such session.
+func (a *App) resumeSession(token string, conn *websocket.Conn, ticket string, expiration *time.Time) *Client {
+	a.lock.Lock()
+	cl, ok := a.sessions[token]
+	a.lock.Unlock()
+	if !ok || !cl.resume(conn, ticket, expiration) {
+		return nil
+	}
+	return cl
+}
@@ -0,0 +1,137 @@
+package panda
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionResumption(t *testing.T) {
+	app := NewApp(Config{SessionGracePeriod: time.Second})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+
+	hello := readTestMessage(t, conn)
+	if hello.MsgType != Session || hello.Message == "" || hello.ID != client.GetID() {
+		t.Fatalf("got %+v, want a Session frame", hello)
+	}
+	if client.Resumed() {
+		t.Error("expected a new session not to be resumed")
+	}
+	client.Join("room")
+	readTestMessage(t, conn)
+
+	// the connection drops without a close frame.
+	conn.UnderlyingConn().Close()
+	waitFor(t, client.detached)
+	app.Broadcast("room", "missed")
+	app.fanouts.Wait()
+	client.Send("direct")
+
+	resumedConn, resumed := dialTestClient(t, app, url+"?session="+hello.Message)
+	if resumed != client || !resumed.Resumed() {
+		t.Fatal("expected the session to be resumed by the same client")
+	}
+	if m := readTestMessage(t, resumedConn); m.MsgType != Session || m.Message != hello.Message || m.ID != hello.ID {
+		t.Fatalf("got %+v, want the same Session frame", m)
+	}
+	for _, want := range []string{"missed", "direct"} {
+		if m := readTestMessage(t, resumedConn); m.Message != want {
+			t.Fatalf("got %+v, want the buffered message %q", m, want)
+		}
+	}
+	if got := client.Channels(); !reflect.DeepEqual(got, []string{"room"}) {
+		t.Errorf("got channels %v after resuming", got)
+	}
+	app.Broadcast("room", "live")
+	if m := readTestMessage(t, resumedConn); m.Message != "live" || m.Seq != 2 {
+		t.Fatalf("got %+v, want the live message", m)
+	}
+
+	// a client which says goodbye does not keep its session.
+	resumedConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("client was not destroyed after closing normally")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	app := NewApp(Config{SessionGracePeriod: 20 * time.Millisecond})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+	hello := readTestMessage(t, conn)
+
+	conn.UnderlyingConn().Close()
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("client was not destroyed after the grace period")
+	}
+
+	newConn, newClient := dialTestClient(t, app, url+"?session="+hello.Message)
+	if newClient == client || newClient.Resumed() {
+		t.Error("expected an expired session to be replaced by a new one")
+	}
+	if m := readTestMessage(t, newConn); m.MsgType != Session || m.Message == hello.Message {
+		t.Errorf("got %+v, want a new Session frame", m)
+	}
+	if got := app.GetClientsCount(); got != 1 {
+		t.Errorf("got %d clients, want 1", got)
+	}
+}
+
+func TestSessionTakeover(t *testing.T) {
+	app := NewApp(Config{SessionGracePeriod: time.Second})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url)
+	hello := readTestMessage(t, conn)
+
+	// the client reconnects before the server notices that the old
+	// connection is lost.
+	newConn, resumed := dialTestClient(t, app, url+"?session="+hello.Message)
+	if resumed != client {
+		t.Fatal("expected the session to be taken over")
+	}
+	readTestMessage(t, newConn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expected the old connection to be closed")
+	}
+	client.Send("hi")
+	if m := readTestMessage(t, newConn); m.Message != "hi" {
+		t.Fatalf("got %+v on the new connection", m)
+	}
+}
+
+// a resumed session takes the ticket of the new connection and its
+// expiration.
+func TestSessionTicket(t *testing.T) {
+	expirations := map[string]time.Duration{"old": time.Hour, "new": 50 * time.Millisecond}
+	app := NewApp(Config{
+		SessionGracePeriod: time.Second,
+		AuthenticationHandler: func(ticket string) (*time.Time, bool) {
+			expiration, ok := expirations[ticket]
+			destructionTime := time.Now().Add(expiration)
+			return &destructionTime, ok
+		},
+	})
+	_, url := newTestServer(t, app)
+	conn, client := dialTestClient(t, app, url+"?ticket=old")
+	hello := readTestMessage(t, conn)
+
+	conn.UnderlyingConn().Close()
+	waitFor(t, client.detached)
+	_, resumed := dialTestClient(t, app, url+"?ticket=new&session="+hello.Message)
+	if resumed != client || client.GetTicket() != "new" {
+		t.Fatalf("got ticket %q, want the new one", client.GetTicket())
+	}
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("client was not destroyed once its new ticket expired")
+	}
+}
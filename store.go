@@ -0,0 +1,150 @@
+package panda
+
+import (
+	"sync"
+	"time"
+)
+
+// StoredMessage is a message of a channel which is kept in a MessageStore
+// with the time it was sent.
+type StoredMessage struct {
+	Message *Message
+	Time    time.Time
+}
+
+// MessageStore keeps the messages of channels, so that they can be
+// replayed to subscribers which ask for the history. The messages of a
+// channel are appended in the order of their sequence numbers, one at a
+// time, but messages of different channels may be appended concurrently.
+type MessageStore interface {
+	// Append keeps a message of its channel (message.Message.Channel).
+	Append(message StoredMessage) error
+	// Range returns the kept messages of the channel whose sequence
+	// numbers are greater than since and which were sent at or after
+	// from, in order. If limit is greater than zero, it returns only the
+	// last limit of them, so that stores can read back from the newest
+	// message and stop there.
+	Range(channel string, since uint64, from time.Time, limit int) ([]StoredMessage, error)
+	// Trim lets go of the messages of the channel whose sequence numbers
+	// are less than before or which were sent before olderThan. A store
+	// may keep them longer (e.g. until a whole segment can be dropped).
+	Trim(channel string, before uint64, olderThan time.Time) error
+	// LastSeq returns the sequence number of the last kept message of the
+	// channel, so that its numbering goes on after a restart.
+	LastSeq(channel string) (uint64, error)
+}
+
+// MemoryStore is a MessageStore which keeps messages in memory. It is
+// used when HistorySize or HistoryTTL is set and there is no MessageStore.
+// The messages of each channel are kept in a ring buffer, so that appending
+// and trimming a message take constant time.
+type MemoryStore struct {
+	lock *sync.Mutex
+	logs map[string]*memoryLog
+}
+
+// a ring buffer of the messages of a channel, oldest first. It grows
+// when it is full.
+type memoryLog struct {
+	messages []StoredMessage
+	head     int
+	count    int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		lock: &sync.Mutex{},
+		logs: make(map[string]*memoryLog),
+	}
+}
+
+func (s *MemoryStore) Append(message StoredMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.logs[message.Message.Channel]
+	if !ok {
+		l = &memoryLog{}
+		s.logs[message.Message.Channel] = l
+	}
+	l.push(message)
+	return nil
+}
+
+func (s *MemoryStore) Range(channel string, since uint64, from time.Time, limit int) ([]StoredMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.logs[channel]
+	if !ok {
+		return nil, nil
+	}
+	// messages are in the order of their sequence numbers and times, so
+	// that the matching ones are the last ones.
+	first := l.count
+	for first > 0 && (limit <= 0 || l.count-first < limit) {
+		m := l.at(first - 1)
+		if m.Message.Seq <= since || m.Time.Before(from) {
+			break
+		}
+		first--
+	}
+	if first == l.count {
+		return nil, nil
+	}
+	messages := make([]StoredMessage, 0, l.count-first)
+	for i := first; i < l.count; i++ {
+		messages = append(messages, l.at(i))
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) Trim(channel string, before uint64, olderThan time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.logs[channel]
+	if !ok {
+		return nil
+	}
+	for l.count > 0 && (l.at(0).Message.Seq < before || l.at(0).Time.Before(olderThan)) {
+		l.pop()
+	}
+	if l.count == 0 {
+		delete(s.logs, channel)
+	}
+	return nil
+}
+
+func (s *MemoryStore) LastSeq(channel string) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.logs[channel]
+	if !ok {
+		return 0, nil
+	}
+	return l.at(l.count - 1).Message.Seq, nil
+}
+
+// returns the i-th message, oldest first.
+func (l *memoryLog) at(i int) StoredMessage {
+	return l.messages[(l.head+i)%len(l.messages)]
+}
+
+// appends a message and doubles the buffer if it is full.
+func (l *memoryLog) push(message StoredMessage) {
+	if l.count == len(l.messages) {
+		messages := make([]StoredMessage, 2*len(l.messages)+1)
+		for i := 0; i < l.count; i++ {
+			messages[i] = l.at(i)
+		}
+		l.messages = messages
+		l.head = 0
+	}
+	l.messages[(l.head+l.count)%len(l.messages)] = message
+	l.count++
+}
+
+// removes the oldest message.
+func (l *memoryLog) pop() {
+	l.messages[l.head] = StoredMessage{}
+	l.head = (l.head + 1) % len(l.messages)
+	l.count--
+}
@@ -0,0 +1,104 @@
+package panda
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// checks a MessageStore which keeps the messages as they are asked to.
+func testMessageStore(t *testing.T, store MessageStore) {
+	t.Helper()
+	start := time.Unix(1700000000, 0)
+	for seq := uint64(1); seq <= 5; seq++ {
+		err := store.Append(StoredMessage{
+			Message: &Message{Channel: "room", Message: fmt.Sprint(seq), Seq: seq},
+			Time:    start.Add(time.Duration(seq) * time.Second),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Append(StoredMessage{Message: &Message{Channel: "other", Seq: 1}, Time: start}); err != nil {
+		t.Fatal(err)
+	}
+
+	seqs := func(since uint64, from time.Time, limit int) string {
+		t.Helper()
+		messages, err := store.Range("room", since, from, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, m := range messages {
+			if m.Message.Message != fmt.Sprint(m.Message.Seq) {
+				t.Errorf("got message %+v", m.Message)
+			}
+			got = append(got, m.Message.Seq)
+		}
+		return fmt.Sprint(got)
+	}
+	if got := seqs(0, time.Time{}, 0); got != "[1 2 3 4 5]" {
+		t.Errorf("got %s, want all of the messages", got)
+	}
+	if got := seqs(3, time.Time{}, 0); got != "[4 5]" {
+		t.Errorf("got %s, want the messages after 3", got)
+	}
+	if got := seqs(0, start.Add(2*time.Second), 0); got != "[2 3 4 5]" {
+		t.Errorf("got %s, want the messages from the 2nd second", got)
+	}
+	if got := seqs(0, time.Time{}, 2); got != "[4 5]" {
+		t.Errorf("got %s, want the last 2 messages", got)
+	}
+	if got := seqs(3, time.Time{}, 10); got != "[4 5]" {
+		t.Errorf("got %s, want the messages after 3", got)
+	}
+	if seq, err := store.LastSeq("room"); err != nil || seq != 5 {
+		t.Errorf("got last seq %d, %v", seq, err)
+	}
+	if seq, err := store.LastSeq("missing"); err != nil || seq != 0 {
+		t.Errorf("got last seq %d, %v for a missing channel", seq, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	testMessageStore(t, store)
+
+	if err := store.Trim("room", 3, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := store.Range("room", 0, time.Time{}, 0)
+	if len(messages) != 3 || messages[0].Message.Seq != 3 {
+		t.Errorf("got %d messages after trimming", len(messages))
+	}
+	if err := store.Trim("room", 0, time.Unix(1700000000, 0).Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if messages, _ := store.Range("room", 0, time.Time{}, 0); len(messages) != 0 {
+		t.Errorf("got %d messages, want none", len(messages))
+	}
+	if seq, _ := store.LastSeq("other"); seq != 1 {
+		t.Error("expected trimming not to touch other channels")
+	}
+}
+
+func TestMemoryStoreRing(t *testing.T) {
+	store := NewMemoryStore()
+	// the buffer wraps around as messages are appended and trimmed.
+	for seq := uint64(1); seq <= 100; seq++ {
+		if err := store.Append(StoredMessage{Message: &Message{Channel: "room", Seq: seq}}); err != nil {
+			t.Fatal(err)
+		}
+		if seq > 3 {
+			store.Trim("room", seq-2, time.Time{})
+		}
+	}
+	messages, _ := store.Range("room", 0, time.Time{}, 0)
+	if len(messages) != 3 || messages[0].Message.Seq != 98 || messages[2].Message.Seq != 100 {
+		t.Errorf("got %v, want the last 3 messages", messages)
+	}
+	if got := len(store.logs["room"].messages); got > 8 {
+		t.Errorf("got a buffer of %d messages, want it not to grow", got)
+	}
+}
@@ -0,0 +1,287 @@
+package panda
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy decides what happens to a frame which is sent
+// to a client whose outbound queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// the new frame is dropped.
+	DropNewest SlowConsumerPolicy = iota
+	// the oldest queued frame is dropped to make room for the new one.
+	DropOldest
+	// the sender waits up to WriteQueueTimeout for room in the queue
+	// and drops the frame if there is still none. It trades isolation for
+	// delivery: a broadcast is sent by a fanout worker, which waits for a
+	// stuck client before it goes on with the other clients of its shard.
+	Block
+	// the client is closed with SlowConsumerCloseCode and
+	// SlowConsumerCloseReason.
+	Disconnect
+)
+
+// a frame which waits in a client's outbound queue.
+type frame struct {
+	frameType int
+	data      []byte
+	// set for frames which are sent to many clients, so that they
+	// are framed and compressed once per compression setting rather
+	// than once per client.
+	prepared *websocket.PreparedMessage
+	// the message which data is encoded from. It is nil for frames
+	// which are not messages (e.g. close frames).
+	message *Message
+}
+
+// makes a frame for a broadcast.
+func newPreparedFrame(frameType int, data []byte, message *Message) (*frame, error) {
+	prepared, err := websocket.NewPreparedMessage(frameType, data)
+	if err != nil {
+		return nil, err
+	}
+	return &frame{frameType: frameType, data: data, prepared: prepared, message: message}, nil
+}
+
+// queues a frame for the client's writer regarding SlowConsumerPolicy.
+// It is the single point which every outbound message goes through, so
+// that the interceptors run here. It returns false if the frame was
+// dropped or vetoed.
+func (c *Client) enqueue(f *frame) bool {
+	if f = c.intercept(f); f == nil {
+		return false
+	}
+	select {
+	case c.outbound <- f:
+		return true
+	case <-c.ctx.Done():
+		return false
+	default:
+	}
+
+	switch c.app.config.SlowConsumerPolicy {
+	case DropOldest:
+		for {
+			select {
+			case <-c.outbound:
+				atomic.AddUint64(&c.app.metrics.droppedMessages, 1)
+			default:
+			}
+			select {
+			case c.outbound <- f:
+				return true
+			case <-c.ctx.Done():
+				return false
+			default:
+			}
+		}
+	case Block:
+		timer := time.NewTimer(c.app.config.WriteQueueTimeout)
+		defer timer.Stop()
+		select {
+		case c.outbound <- f:
+			return true
+		case <-c.ctx.Done():
+			return false
+		case <-timer.C:
+		}
+	case Disconnect:
+		if atomic.CompareAndSwapUint32(&c.isDisconnecting, 0, 1) {
+			atomic.AddUint64(&c.app.metrics.slowConsumerDisconnects, 1)
+			c.logger.Warn("client " + c.id + " is too slow, disconnecting it")
+			go c.closeNow(c.app.config.SlowConsumerCloseCode, c.app.config.SlowConsumerCloseReason)
+		}
+	}
+
+	atomic.AddUint64(&c.app.metrics.droppedMessages, 1)
+	return false
+}
+
+// tells the writer to hold back the queued frames until the replay which
+// is being read is queued by enqueueReplay.
+func (c *Client) beginReplay() {
+	c.replayLock.Lock()
+	defer c.replayLock.Unlock()
+	c.replaying++
+}
+
+// queues frames of a channel's history for the client's writer and ends
+// the replay which beginReplay began. They are not subject to
+// SlowConsumerPolicy, as the client asked for them (and MaxReplay limits
+// them), and they are written before the frames which are queued after
+// beginReplay.
+func (c *Client) enqueueReplay(frames []*frame) {
+	c.replayLock.Lock()
+	for _, f := range frames {
+		if f = c.intercept(f); f != nil {
+			c.replayed = append(c.replayed, f)
+		}
+	}
+	c.replaying--
+	if c.replaying == 0 {
+		c.replayed = append(c.replayed, c.held...)
+		c.held = nil
+	}
+	c.replayLock.Unlock()
+	select {
+	case c.replayReady <- struct{}{}:
+	default:
+	}
+}
+
+// reports whether the writer must hold back the queued frames.
+func (c *Client) isReplaying() bool {
+	c.replayLock.Lock()
+	defer c.replayLock.Unlock()
+	return c.replaying > 0
+}
+
+// returns the next replayed frame, or queued if there is none. Replayed
+// frames may have been added since queued was dequeued, so that it is put
+// behind them; and a replay may have begun since, so that it is held until
+// the replay is queued.
+func (c *Client) nextReplayed(queued *frame) *frame {
+	c.replayLock.Lock()
+	defer c.replayLock.Unlock()
+	if queued != nil && c.replaying > 0 {
+		c.held = append(c.held, queued)
+		queued = nil
+	}
+	if len(c.replayed) == 0 {
+		return queued
+	}
+	if queued != nil {
+		c.replayed = append(c.replayed, queued)
+	}
+	f := c.replayed[0]
+	c.replayed[0] = nil
+	c.replayed = c.replayed[1:]
+	return f
+}
+
+// writes the queued frames to a connection one by one until it is lost
+// or the client is destroyed. It is the only goroutine which writes data
+// frames to the connection. It begins once the writer of the previous
+// connection (if any) returns, and writes hello (if any) and the frame
+// which that writer could not write first.
+func (c *Client) writer(conn *websocket.Conn, connDone chan struct{}, previous chan struct{}, done chan struct{}, hello *frame) {
+	defer close(done)
+	if previous != nil {
+		<-previous
+	}
+	if hello != nil {
+		if err := c.write(conn, hello); err != nil {
+			c.logger.Error(err.Error())
+			c.connectionLost(conn, false)
+			return
+		}
+	}
+	for {
+		f := c.pending
+		if f == nil {
+			f = c.nextReplayed(nil)
+		}
+		if f == nil {
+			// a nil channel is never ready.
+			var outbound chan *frame
+			if !c.isReplaying() {
+				outbound = c.outbound
+			}
+			select {
+			case f = <-outbound:
+				if f = c.nextReplayed(f); f == nil {
+					continue
+				}
+			case <-c.replayReady:
+				continue
+			case <-connDone:
+				return
+			case <-c.ctx.Done():
+				return
+			}
+		}
+		if f.frameType == websocket.CloseMessage {
+			if err := conn.WriteControl(websocket.CloseMessage, f.data, time.Now().Add(DefaultCloseFrameTimeout)); err != nil {
+				c.logger.Error(err.Error())
+			}
+			c.Destroy()
+			return
+		}
+		c.pending = f
+		if err := c.write(conn, f); err != nil {
+			// If connection is broken, there will be no need to
+			// keep it anymore. The frame is written again if the
+			// session is resumed.
+			c.logger.Error(err.Error())
+			c.connectionLost(conn, false)
+			return
+		}
+		c.pending = nil
+	}
+}
+
+// writes a frame regarding WriteTimeout. Only the writer calls it.
+func (c *Client) write(conn *websocket.Conn, f *frame) error {
+	if c.app.config.WriteTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(c.app.config.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+	if f.prepared != nil {
+		return conn.WritePreparedMessage(f.prepared)
+	}
+	return conn.WriteMessage(f.frameType, f.data)
+}
+
+// queues a close frame behind the pending frames, so that they are
+// delivered first, and waits until the client is destroyed. If the
+// deadline passes before that, the client is closed right away.
+func (c *Client) close(code int, reason string, deadline time.Time) {
+	if c.detached() {
+		c.Destroy()
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	closeFrame := &frame{
+		frameType: websocket.CloseMessage,
+		data:      websocket.FormatCloseMessage(code, reason),
+	}
+	select {
+	case c.outbound <- closeFrame:
+	case <-c.ctx.Done():
+		return
+	case <-timer.C:
+		c.closeNow(code, reason)
+		return
+	}
+	select {
+	case <-c.ctx.Done():
+	case <-timer.C:
+		c.closeNow(code, reason)
+	}
+}
+
+// sends a close frame without waiting for the queued frames and
+// destroys the client.
+func (c *Client) closeNow(code int, reason string) {
+	c.lock.Lock()
+	conn, isDetached := c.conn, c.isDetached
+	c.lock.Unlock()
+	if isDetached {
+		c.Destroy()
+		return
+	}
+	deadline := time.Now().Add(DefaultCloseFrameTimeout)
+	if err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline); err != nil {
+		c.logger.Error(err.Error())
+	}
+	if err := c.Destroy(); err != nil {
+		c.logger.Error(err.Error())
+	}
+}
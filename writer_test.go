@@ -0,0 +1,110 @@
+package panda
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// makes a client whose writer is not running, so that its queue fills up.
+func newQueueTestClient(config Config) *Client {
+	app := NewApp(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		ctx:       ctx,
+		cancelCtx: cancel,
+		app:       app,
+		id:        makeId(),
+		outbound:  make(chan *frame, app.config.WriteQueueSize),
+		logger:    app.config.Logger,
+	}
+}
+
+func queuedFrames(c *Client) []string {
+	var frames []string
+	for {
+		select {
+		case f := <-c.outbound:
+			frames = append(frames, string(f.data))
+		default:
+			return frames
+		}
+	}
+}
+
+func TestEnqueue(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  SlowConsumerPolicy
+		queued  []string
+		dropped uint64
+	}{
+		{"drop newest", DropNewest, []string{"1", "2"}, 1},
+		{"drop oldest", DropOldest, []string{"2", "3"}, 1},
+		{"block", Block, []string{"1", "2"}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newQueueTestClient(Config{
+				WriteQueueSize:     2,
+				SlowConsumerPolicy: tc.policy,
+				WriteQueueTimeout:  10 * time.Millisecond,
+			})
+			for _, data := range []string{"1", "2", "3"} {
+				c.enqueue(&frame{frameType: websocket.TextMessage, data: []byte(data)})
+			}
+			queued := queuedFrames(c)
+			if len(queued) != len(tc.queued) || queued[0] != tc.queued[0] || queued[1] != tc.queued[1] {
+				t.Errorf("got queued frames %v, want %v", queued, tc.queued)
+			}
+			if got := c.app.Metrics().DroppedMessages; got != tc.dropped {
+				t.Errorf("got %d dropped messages, want %d", got, tc.dropped)
+			}
+		})
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	app := NewApp(Config{
+		WriteQueueSize:     1,
+		SlowConsumerPolicy: Disconnect,
+	})
+	connected := make(chan *Client, 1)
+	app.NewConnection(func(client *Client) {
+		connected <- client
+	})
+	_, url := newTestServer(t, app)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := <-connected
+
+	// the test client does not read, so that the writer gets stuck
+	// once the socket buffers are full and the queue fills up.
+	message := strings.Repeat("x", 64*1024)
+	for i := 0; i < 1000 && client.Context().Err() == nil; i++ {
+		client.Send(message)
+	}
+	select {
+	case <-client.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("slow client was not disconnected")
+	}
+	if got := app.Metrics().SlowConsumerDisconnects; got != 1 {
+		t.Errorf("got %d disconnects, want 1", got)
+	}
+
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected a policy violation close frame, got %v", err)
+	}
+}